@@ -0,0 +1,163 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// Entry is one line of the journal. Data holds the command as JSON, Type
+// tells the reader what to decode it into.
+type Entry struct {
+	Seq  uint64          `json:"seq"`
+	Type string          `json:"type"`
+	Time int64           `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Journal is an append-only file of commands, one JSON Entry per line. Every
+// Append is synced to disk before it returns, so a command that was applied
+// is always found again by Replay.
+type Journal struct {
+	file *os.File
+	seq  uint64
+	size int64
+}
+
+// Open opens the journal at path, creating it if it does not exist. Replay it
+// before the first Append.
+func Open(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{file: file}, nil
+}
+
+// Replay calls apply for every entry after seq from, in order. Entries up to
+// from are already contained in a snapshot and skipped. A last line left
+// incomplete by a crash is cut off: its command was never applied.
+func (j *Journal) Replay(from uint64, apply func(Entry) error) error {
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	seq, offset, err := read(j.file, from, apply)
+	if err != nil {
+		return err
+	}
+	j.seq = seq
+	return j.truncate(offset)
+}
+
+// Read calls apply for every entry after seq from of the journal at path,
+// like Replay, but leaves the file untouched.
+func Read(path string, from uint64, apply func(Entry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, _, err = read(file, from, apply)
+	return err
+}
+
+// read returns the seq of the last entry and the length of the complete
+// entries.
+func read(r io.Reader, from uint64, apply func(Entry) error) (uint64, int64, error) {
+	seq := from
+	first := true
+	reader := bufio.NewReader(r)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Journal: dropping incomplete entry after seq %d \n", seq)
+			}
+			break
+		}
+		if err != nil {
+			return seq, offset, err
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return seq, offset, fmt.Errorf("journal entry after seq %d: %v", seq, err)
+		}
+		offset += int64(len(line))
+		if first && entry.Seq <= from {
+			continue
+		}
+		if entry.Seq != seq+1 {
+			return seq, offset, fmt.Errorf("journal entry %d follows %d", entry.Seq, seq)
+		}
+		first = false
+		if err := apply(entry); err != nil {
+			return seq, offset, err
+		}
+		seq = entry.Seq
+	}
+	return seq, offset, nil
+}
+
+func (j *Journal) truncate(size int64) error {
+	if err := j.file.Truncate(size); err != nil {
+		return err
+	}
+	j.size = size
+	_, err := j.file.Seek(size, io.SeekStart)
+	return err
+}
+
+// Append writes a command received at time at (Unix nanoseconds) to the end
+// of the journal and syncs it to disk. A failed Append leaves the journal as
+// it was.
+func (j *Journal) Append(entryType string, at int64, data interface{}) (*Entry, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	entry := Entry{
+		Seq:  j.seq + 1,
+		Type: entryType,
+		Time: at,
+		Data: raw,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	line = append(line, '\n')
+	if _, err := j.file.Write(line); err != nil {
+		j.truncate(j.size)
+		return nil, err
+	}
+	if err := j.file.Sync(); err != nil {
+		j.truncate(j.size)
+		return nil, err
+	}
+	j.seq = entry.Seq
+	j.size += int64(len(line))
+	return &entry, nil
+}
+
+// Truncate empties the journal once a snapshot holds all of its entries. The
+// sequence numbers carry on where they were.
+func (j *Journal) Truncate() error {
+	if err := j.truncate(0); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Seq is the sequence number of the last entry in the journal.
+func (j *Journal) Seq() uint64 {
+	return j.seq
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
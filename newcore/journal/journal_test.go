@@ -0,0 +1,150 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func tempJournal(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "journal")
+}
+
+// replay opens the journal at path and returns the data of its entries.
+func replay(t *testing.T, path string) (*Journal, []string) {
+	t.Helper()
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []string
+	err = j.Replay(0, func(entry Entry) error {
+		list = append(list, entry.Type+" "+string(entry.Data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, list
+}
+
+func TestJournal(t *testing.T) {
+	path := tempJournal(t)
+	j, list := replay(t, path)
+	if len(list) != 0 {
+		t.Fatalf("new journal replays %v", list)
+	}
+	for i, data := range []interface{}{"one", 2, map[string]int{"three": 3}} {
+		entry, err := j.Append("test", 0, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Seq != uint64(i+1) {
+			t.Fatalf("entry %d got seq %d", i+1, entry.Seq)
+		}
+	}
+	j.Close()
+
+	// A crash in the middle of a write leaves an incomplete last line.
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`{"seq":4,"type":"test","da`)
+	file.Close()
+
+	j, list = replay(t, path)
+	if got := strings.Join(list, ", "); got != `test "one", test 2, test {"three":3}` || j.Seq() != 3 {
+		t.Fatalf("journal replays %s up to seq %d", got, j.Seq())
+	}
+	if entry, err := j.Append("test", 0, 4); err != nil || entry.Seq != 4 {
+		t.Fatalf("append after the replay got %+v, %v", entry, err)
+	}
+	j.Close()
+
+	j, list = replay(t, path)
+	defer j.Close()
+	if len(list) != 4 || list[3] != "test 4" {
+		t.Fatalf("journal replays %v after the incomplete entry was cut off", list)
+	}
+}
+
+func TestJournalGap(t *testing.T) {
+	path := tempJournal(t)
+	lines := `{"seq":1,"type":"test","time":0,"data":1}` + "\n" + `{"seq":3,"type":"test","time":0,"data":3}` + "\n"
+	if err := ioutil.WriteFile(path, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if err := j.Replay(0, func(Entry) error { return nil }); err == nil || !strings.Contains(err.Error(), "entry 3 follows 1") {
+		t.Fatalf("replay over a gap got %v", err)
+	}
+}
+
+func TestJournalTruncate(t *testing.T) {
+	path := tempJournal(t)
+	j, _ := replay(t, path)
+	for i := 1; i <= 3; i++ {
+		j.Append("test", 0, i)
+	}
+	if err := j.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := j.Append("test", 0, 4); err != nil || entry.Seq != 4 {
+		t.Fatalf("append after the truncate got %+v, %v", entry, err)
+	}
+	j.Close()
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	var list []uint64
+	if err := j.Replay(3, func(entry Entry) error {
+		list = append(list, entry.Seq)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != 4 || j.Seq() != 4 {
+		t.Fatalf("journal after a snapshot at 3 replays %v up to seq %d", list, j.Seq())
+	}
+}
+
+func TestRead(t *testing.T) {
+	path := tempJournal(t)
+	j, _ := replay(t, path)
+	for i := 1; i <= 3; i++ {
+		j.Append("test", int64(i)*1000, i)
+	}
+	j.Close()
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`{"seq":4`)
+	file.Close()
+	before, _ := ioutil.ReadFile(path)
+
+	var times []int64
+	err := Read(path, 1, func(entry Entry) error {
+		times = append(times, entry.Time)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 2 || times[0] != 2000 || times[1] != 3000 {
+		t.Fatalf("read after seq 1 gives entries at %v", times)
+	}
+	if after, _ := ioutil.ReadFile(path); string(after) != string(before) {
+		t.Fatal("read changed the journal")
+	}
+}
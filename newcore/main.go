@@ -5,14 +5,55 @@ import (
 	"./stackserver"
 	"./webserver"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"time"
 )
 
 var market *reactor.Market
 
+var replyTimeout = flag.Duration("timeout", 5*time.Second, "how long the webserver waits for a stackserver reply")
+var journalPath = flag.String("journal", "", "file the stackserver journals its commands to and recovers from")
+var snapshotPath = flag.String("snapshot", "", "file the stackserver saves the market to and recovers from")
+var snapshotEvery = flag.Int("snapshot-every", 10000, "commands between two snapshots")
+var eventLogPath = flag.String("events", "", "file the stackserver logs its events to")
+var accounts = flag.Bool("accounts", false, "tie orders to account balances")
+var expireEvery = flag.Duration("expire-every", time.Second, "how often the stackserver cancels expired GTD orders, never when 0")
+var improvement = flag.String("improvement", "house", "who gets the price improvement of swaps: house, taker or maker")
+var tokensPath = flag.String("tokens", "", "JSON file mapping the bearer tokens of clients to their owners")
+
 func main() {
-	fmt.Println("Start")
+	flag.Parse()
+	switch reactor.ImprovementPolicy(*improvement) {
+	case reactor.ImproveHouse, reactor.ImproveTaker, reactor.ImproveMaker:
+	default:
+		log.Fatalf("unknown improvement policy %q", *improvement)
+	}
+	switch flag.Arg(0) {
+	case "replay":
+		// replay [file] writes the events of the journal to file or stdout.
+		out := os.Stdout
+		if flag.Arg(1) != "" {
+			file, err := os.Create(flag.Arg(1))
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			out = file
+		}
+		if err := writeReplay(out); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "verify":
+		// verify <event log> replays the journal and diffs it with the log.
+		if err := verifyReplay(flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	//testMarket()
 	testChannels()
 }
@@ -21,33 +62,47 @@ func testChannels() {
 	var ch1 = make(chan interface{}, 10000)
 	var ch2 = make(chan reactor.Event, 10000)
 
-	go stackserver.StartServer(ch1, ch2)
-	go webserver.StartServer(ch1)
-
-	go func() {
-		m, err := json.Marshal(<-ch2)
-		if err == nil {
-			fmt.Println(string(m))
+	if *tokensPath != "" {
+		if err := webserver.LoadTokens(*tokensPath); err != nil {
+			log.Fatal(err)
 		}
-	}()
+	}
+	fmt.Println("Start")
+	go stackserver.StartServer(ch1, ch2, serverOptions())
+	go webserver.StartServer(ch1, ch2, *replyTimeout)
 
 	var input string
 	fmt.Scanln(&input)
 }
 
+// serverOptions are the stackserver options given on the command line.
+func serverOptions() stackserver.Options {
+	return stackserver.Options{
+		JournalPath:       *journalPath,
+		SnapshotPath:      *snapshotPath,
+		SnapshotEvery:     *snapshotEvery,
+		EventLogPath:      *eventLogPath,
+		Accounts:          *accounts,
+		ImprovementPolicy: reactor.ImprovementPolicy(*improvement),
+		ExpireEvery:       *expireEvery,
+	}
+}
+
 func testMarket() {
 	market = reactor.CreateMarket()
 	var eventList []reactor.Event
 
+	market.AddCurrency("BTC", 8)
+	market.AddCurrency("USD", 2)
 	market.AddPair("BTC", "USD")
-	eventList = market.AddNewOrder(1, "BTC/USD", false, 1.9, 65000.01)
+	eventList, _ = market.AddNewOrderString(1, "test", "BTC/USD", false, "1.9", "65000.01")
 	json.NewEncoder(log.Writer()).Encode(eventList)
-	eventList = market.AddNewOrder(2, "BTC/USD", false, 2.31, 65000)
+	eventList, _ = market.AddNewOrderString(2, "test", "BTC/USD", false, "2.31", "65000")
 	json.NewEncoder(log.Writer()).Encode(eventList)
-	eventList = market.CancelOrder(1)
+	eventList, _ = market.CancelOrder(1)
 	json.NewEncoder(log.Writer()).Encode(eventList)
-	eventList = market.AddNewOrder(3, "BTC/USD", true, 0, 100000.12)
+	eventList, _ = market.AddNewOrderString(3, "test", "BTC/USD", true, "0", "100000.12")
 	json.NewEncoder(log.Writer()).Encode(eventList)
-	eventList = market.AddNewOrder(4, "BTC/USD", false, 1.9, 65000.01)
+	eventList, _ = market.AddNewOrderString(4, "test", "BTC/USD", false, "1.9", "65000.01")
 	json.NewEncoder(log.Writer()).Encode(eventList)
 }
@@ -0,0 +1,290 @@
+package reactor
+
+import "sort"
+
+// Balance is what an account holds of one currency. Reserved is locked as
+// the supply of its open orders, Available is free to trade or withdraw.
+type Balance struct {
+	Currency  string `json:"currency"`
+	Available uint64 `json:"available"`
+	Reserved  uint64 `json:"reserved"`
+}
+
+// ledger keeps the balances of every account, by owner and currency, the
+// total deposited less withdrawn per currency that the balances must add up
+// to, and every transfer by its TxId.
+type ledger struct {
+	accounts  map[string]map[string]*Balance
+	deposited map[string]uint64
+	transfers map[string]*Transfer
+}
+
+// WithAccounts ties every order to the account of its owner. An order is only
+// accepted when the account has its supply available, which stays reserved
+// until the order trades it or is closed.
+func WithAccounts() Option {
+	return func(m *Market) {
+		m.ledger = newLedger()
+	}
+}
+
+func newLedger() *ledger {
+	return &ledger{
+		accounts:  make(map[string]map[string]*Balance),
+		deposited: make(map[string]uint64),
+		transfers: make(map[string]*Transfer),
+	}
+}
+
+func (l *ledger) balance(owner string, currency string) *Balance {
+	account, exists := l.accounts[owner]
+	if !exists {
+		account = make(map[string]*Balance)
+		l.accounts[owner] = account
+	}
+	balance, exists := account[currency]
+	if !exists {
+		balance = &Balance{Currency: currency}
+		account[currency] = balance
+	}
+	return balance
+}
+
+type TransferKind string
+
+const (
+	DepositTransfer    TransferKind = "deposit"
+	WithdrawalTransfer TransferKind = "withdrawal"
+)
+
+// Transfer moves money into or out of the available balance of an account.
+// TxId is chosen by the client, so a transfer that is sent again is
+// recognised and not applied twice. Balance is the balance of the account
+// right after the transfer.
+type Transfer struct {
+	TxId    string       `json:"txId"`
+	Account string       `json:"account"`
+	Kind    TransferKind `json:"kind"`
+	Money   Money        `json:"money"`
+	Balance Balance      `json:"balance"`
+}
+
+// Deposit credits amount of currency to the available balance of account.
+func (m *Market) Deposit(txId string, account string, currency string, amount uint64) ([]Event, error) {
+	return m.transfer(DepositTransfer, txId, account, currency, amount)
+}
+
+// Withdraw debits amount of currency from the available balance of account.
+// Money reserved by open orders cannot be withdrawn.
+func (m *Market) Withdraw(txId string, account string, currency string, amount uint64) ([]Event, error) {
+	return m.transfer(WithdrawalTransfer, txId, account, currency, amount)
+}
+
+// DepositString and WithdrawString take the amount as a decimal number with
+// at most the precision of the currency.
+func (m *Market) DepositString(txId string, account string, currency string, amount string) ([]Event, error) {
+	return m.transferString(DepositTransfer, txId, account, currency, amount)
+}
+
+func (m *Market) WithdrawString(txId string, account string, currency string, amount string) ([]Event, error) {
+	return m.transferString(WithdrawalTransfer, txId, account, currency, amount)
+}
+
+func (m *Market) transferString(kind TransferKind, txId string, account string, currency string, amount string) ([]Event, error) {
+	m.lastEvents = m.lastEvents[:0]
+	c, exists := m.currencyMap[currency]
+	if !exists {
+		err := newError(ErrUnknownCurrency, "currency %s not found", currency)
+		m.errorEvent(nil, err)
+		return m.lastEvents, err
+	}
+	value, err := c.Parse(amount)
+	if err != nil {
+		m.errorEvent(nil, err)
+		return m.lastEvents, err
+	}
+	return m.transfer(kind, txId, account, currency, value)
+}
+
+// transfer applies a transfer once. Sending it again answers without events,
+// sending another transfer with the same TxId is refused.
+func (m *Market) transfer(kind TransferKind, txId string, account string, currency string, amount uint64) ([]Event, error) {
+	m.lastEvents = m.lastEvents[:0]
+	done, err := m.prepareTransfer(kind, txId, account, currency, amount)
+	if err != nil {
+		m.errorEvent(nil, err)
+		return m.lastEvents, err
+	}
+	if done {
+		return m.lastEvents, nil
+	}
+
+	balance := m.ledger.balance(account, currency)
+	if kind == DepositTransfer {
+		balance.Available += amount
+		m.ledger.deposited[currency] += amount
+	} else {
+		balance.Available -= amount
+		m.ledger.deposited[currency] -= amount
+	}
+	transfer := &Transfer{
+		TxId:    txId,
+		Account: account,
+		Kind:    kind,
+		Money:   Money{Currency: currency, Amount: amount},
+		Balance: *balance,
+	}
+	m.ledger.transfers[txId] = transfer
+
+	m.lastEventId++
+	event := Event{
+		Id:        m.lastEventId,
+		Time:      m.now(),
+		EventType: Ledger,
+		Transfer:  transfer,
+	}
+	m.lastEvents = append(m.lastEvents, event)
+	m.checkInvariants()
+	return m.lastEvents, nil
+}
+
+// prepareTransfer validates a transfer and tells whether it was applied
+// before.
+func (m *Market) prepareTransfer(kind TransferKind, txId string, account string, currency string, amount uint64) (bool, *MarketError) {
+	if m.ledger == nil {
+		return false, newError(ErrNoAccounts, "market has no accounts")
+	}
+	if txId == "" {
+		return false, newError(ErrInvalidTransfer, "transaction id is empty")
+	}
+	if done, exists := m.ledger.transfers[txId]; exists {
+		if done.Kind != kind || done.Account != account || done.Money.Currency != currency || done.Money.Amount != amount {
+			return false, newError(ErrDuplicateTransfer, "transaction %s exists", txId)
+		}
+		return true, nil
+	}
+	if account == "" || account == HouseAccount {
+		return false, newError(ErrInvalidAccount, "account name %q not allowed", account)
+	}
+	if _, exists := m.currencyMap[currency]; !exists {
+		return false, newError(ErrUnknownCurrency, "currency %s not found", currency)
+	}
+	if amount == 0 {
+		return false, newError(ErrInvalidAmount, "%s of 0 %s not allowed", kind, currency)
+	}
+	balance := m.ledger.balance(account, currency)
+	if kind == DepositTransfer {
+		if balance.Available+balance.Reserved+amount < amount || m.ledger.deposited[currency]+amount < amount {
+			return false, newError(ErrInvalidAmount, "deposit of %d %s is out of range", amount, currency)
+		}
+	} else if balance.Available < amount {
+		return false, newError(ErrInsufficientFunds, "account %q has %d %s available, withdrawal of %d refused",
+			account, balance.Available, currency, amount)
+	}
+	return false, nil
+}
+
+// Transfer returns a copy of the transfer applied with txId.
+func (m *Market) Transfer(txId string) (*Transfer, bool) {
+	if m.ledger == nil {
+		return nil, false
+	}
+	done, exists := m.ledger.transfers[txId]
+	if !exists {
+		return nil, false
+	}
+	transfer := *done
+	return &transfer, true
+}
+
+// Balances returns the balances of owner, sorted by currency.
+func (m *Market) Balances(owner string) ([]Balance, error) {
+	if m.ledger == nil {
+		return nil, newError(ErrNoAccounts, "market has no accounts")
+	}
+	list := make([]Balance, 0, len(m.ledger.accounts[owner]))
+	for _, balance := range m.ledger.accounts[owner] {
+		list = append(list, *balance)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Currency < list[j].Currency })
+	return list, nil
+}
+
+// reserve locks the supply of a new order in the account of its owner.
+func (m *Market) reserve(o *Order) *MarketError {
+	if m.ledger == nil {
+		return nil
+	}
+	balance := m.ledger.balance(o.Owner, o.Supply.Currency)
+	if balance.Available < o.Supply.Amount {
+		return newError(ErrInsufficientFunds, "account %q has %d %s available, order %d supplies %d",
+			o.Owner, balance.Available, o.Supply.Currency, o.Id, o.Supply.Amount)
+	}
+	balance.Available -= o.Supply.Amount
+	balance.Reserved += o.Supply.Amount
+	return nil
+}
+
+// release returns the supply a closed order did not trade to its owner.
+func (m *Market) release(o *Order) {
+	if m.ledger == nil {
+		return
+	}
+	balance := m.ledger.balance(o.Owner, o.Supply.Currency)
+	balance.Reserved -= o.Supply.Amount
+	balance.Available += o.Supply.Amount
+}
+
+// settle moves the money of a swap between the accounts of both orders,
+// credits the fees to the house account and the remainders to their
+// beneficiaries.
+func (m *Market) settle(s *Swap) {
+	if m.ledger == nil {
+		return
+	}
+	l := m.ledger
+	green2 := l.balance(s.Green.Owner, s.pair.currency2.Name)
+	green2.Reserved -= s.Money2 + s.Remainder2
+	l.balance(s.beneficiary(s.Remainder2To), s.pair.currency2.Name).Available += s.Remainder2
+	l.balance(s.Green.Owner, s.pair.currency1.Name).Available += s.Money1 - s.Fee1
+	l.balance(HouseAccount, s.pair.currency1.Name).Available += s.Fee1
+
+	red1 := l.balance(s.Red.Owner, s.pair.currency1.Name)
+	red1.Reserved -= s.Money1 + s.Remainder1
+	l.balance(s.beneficiary(s.Remainder1To), s.pair.currency1.Name).Available += s.Remainder1
+	l.balance(s.Red.Owner, s.pair.currency2.Name).Available += s.Money2 - s.Fee2
+	l.balance(HouseAccount, s.pair.currency2.Name).Available += s.Fee2
+}
+
+// checkLedger verifies per currency that the accounts hold exactly what was
+// deposited and that their reservations are the supply of the open orders.
+func (m *Market) checkLedger() {
+	if m.ledger == nil {
+		return
+	}
+	held := make(map[string]uint64)
+	reserved := make(map[string]uint64)
+	for _, account := range m.ledger.accounts {
+		for currency, balance := range account {
+			held[currency] += balance.Available + balance.Reserved
+			reserved[currency] += balance.Reserved
+		}
+	}
+	supply := make(map[string]uint64)
+	for _, order := range m.orderMap {
+		if !order.IsClose {
+			supply[order.Supply.Currency] += order.Supply.Amount
+		}
+	}
+	for _, currency := range m.Currencies() {
+		name := currency.Name
+		if held[name] != m.ledger.deposited[name] {
+			m.violation(Violation{Check: "ledger", Currency: name,
+				Expected: m.ledger.deposited[name], Actual: held[name]})
+		}
+		if reserved[name] != supply[name] {
+			m.violation(Violation{Check: "reserved", Currency: name,
+				Expected: supply[name], Actual: reserved[name]})
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package reactor
+
+import (
+	"errors"
+	"testing"
+)
+
+// balance returns the balance of owner in currency.
+func balance(t *testing.T, m *Market, owner string, currency string) Balance {
+	t.Helper()
+	list, err := m.Balances(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range list {
+		if b.Currency == currency {
+			return b
+		}
+	}
+	return Balance{Currency: currency}
+}
+
+func TestAccounts(t *testing.T) {
+	m, _ := newTestMarket(t, WithAccounts())
+	tr := newTranscript(t)
+
+	tr.step("deposit 100 AAA to a").record(m.Deposit("tx1", "a", "AAA", 100))
+	_, err := tr.step("b buys without money").record(m.AddNewOrder(1, "b", testPair, true, 10, 100))
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("order without money got %v, want %v", err, ErrInsufficientFunds)
+	}
+	tr.step("deposit 500 BBB to b").record(m.Deposit("tx2", "b", "BBB", 500))
+
+	tr.step("a sells 20 for 200").record(m.AddNewOrder(2, "a", testPair, false, 20, 200))
+	if b := balance(t, m, "a", "AAA"); b.Available != 80 || b.Reserved != 20 {
+		t.Fatalf("a has %+v with 20 on the book, want 80 available and 20 reserved", b)
+	}
+	_, err = tr.step("a sells more than is left").record(m.AddNewOrder(3, "a", testPair, false, 90, 900))
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("order above the available balance got %v, want %v", err, ErrInsufficientFunds)
+	}
+
+	// The buyer pays its own price, 60 for 5 at 12. The AAA the seller's
+	// order no longer needs to sell the rest at 10 is the price improvement,
+	// kept by the house.
+	tr.step("b buys 5 for 60").record(m.AddNewOrder(4, "b", testPair, true, 5, 60))
+	if b := balance(t, m, "a", "AAA"); b.Available != 80 || b.Reserved != 14 {
+		t.Fatalf("a has %+v after selling 5, want 80 available and 14 reserved", b)
+	}
+	if b := balance(t, m, HouseAccount, "AAA"); b.Available != 1 {
+		t.Fatalf("house has %+v after the swap, want the improvement of 1 AAA", b)
+	}
+	if b := balance(t, m, "a", "BBB"); b.Available != 60 {
+		t.Fatalf("a has %+v after selling 5 for 60", b)
+	}
+	if b := balance(t, m, "b", "BBB"); b.Available != 440 || b.Reserved != 0 {
+		t.Fatalf("b has %+v after buying 5 for 60", b)
+	}
+	if b := balance(t, m, "b", "AAA"); b.Available != 5 {
+		t.Fatalf("b has %+v after buying 5", b)
+	}
+
+	tr.step("a cancels").record(m.CancelOrder(2))
+	if b := balance(t, m, "a", "AAA"); b.Available != 94 || b.Reserved != 0 {
+		t.Fatalf("a has %+v after the cancel, want 94 available", b)
+	}
+	tr.check("accounts")
+
+	if _, err := CreateMarket().Deposit("tx1", "a", "AAA", 100); !errors.Is(err, ErrNoAccounts) {
+		t.Fatalf("deposit without accounts got %v, want %v", err, ErrNoAccounts)
+	}
+}
+
+func TestTransfers(t *testing.T) {
+	m, _ := newTestMarket(t, WithAccounts())
+	tr := newTranscript(t)
+
+	tr.step("deposit 100 AAA to a").record(m.Deposit("tx1", "a", "AAA", 100))
+	tr.step("deposit again").record(m.Deposit("tx1", "a", "AAA", 100))
+	_, err := tr.step("other deposit with the same transaction").record(m.Deposit("tx1", "a", "AAA", 50))
+	if !errors.Is(err, ErrDuplicateTransfer) {
+		t.Fatalf("reused transaction id got %v, want %v", err, ErrDuplicateTransfer)
+	}
+	if b := balance(t, m, "a", "AAA"); b.Available != 100 {
+		t.Fatalf("a has %+v after one deposit of 100", b)
+	}
+	if transfer, ok := m.Transfer("tx1"); !ok || transfer.Money.Amount != 100 || transfer.Balance.Available != 100 {
+		t.Fatalf("transaction tx1 is %+v, %t", transfer, ok)
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		call func() ([]Event, error)
+	}{
+		{"no transaction id", ErrInvalidTransfer, func() ([]Event, error) { return m.Deposit("", "a", "AAA", 1) }},
+		{"no account", ErrInvalidAccount, func() ([]Event, error) { return m.Deposit("tx2", "", "AAA", 1) }},
+		{"deposit to the house", ErrInvalidAccount, func() ([]Event, error) { return m.Deposit("tx2", HouseAccount, "AAA", 1) }},
+		{"withdrawal from the house", ErrInvalidAccount, func() ([]Event, error) { return m.Withdraw("tx2", HouseAccount, "AAA", 1) }},
+		{"order of the house", ErrInvalidAccount, func() ([]Event, error) { return m.AddNewOrder(2, HouseAccount, testPair, true, 1, 10) }},
+		{"unknown currency", ErrUnknownCurrency, func() ([]Event, error) { return m.Deposit("tx2", "a", "CCC", 1) }},
+		{"nothing", ErrInvalidAmount, func() ([]Event, error) { return m.Deposit("tx2", "a", "AAA", 0) }},
+		{"too many decimals", ErrInvalidAmount, func() ([]Event, error) { return m.DepositString("tx2", "a", "AAA", "1.5") }},
+		{"more than available", ErrInsufficientFunds, func() ([]Event, error) { return m.Withdraw("tx2", "a", "AAA", 101) }},
+	}
+	for _, test := range tests {
+		if _, err := tr.step(test.name).record(test.call()); !errors.Is(err, test.err) {
+			t.Errorf("%s got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	tr.step("a sells 20 for 200").record(m.AddNewOrder(1, "a", testPair, false, 20, 200))
+	_, err = tr.step("a withdraws reserved money").record(m.Withdraw("tx3", "a", "AAA", 90))
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("withdrawing reserved money got %v, want %v", err, ErrInsufficientFunds)
+	}
+	tr.step("a withdraws 80 AAA").record(m.WithdrawString("tx4", "a", "AAA", "80"))
+	if b := balance(t, m, "a", "AAA"); b.Available != 0 || b.Reserved != 20 {
+		t.Fatalf("a has %+v after withdrawing what is not on the book", b)
+	}
+	tr.check("transfers")
+}
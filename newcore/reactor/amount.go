@@ -0,0 +1,117 @@
+package reactor
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Rounding tells the integer math which way to go when a division leaves a
+// remainder.
+//
+// The matching engine never rounds in favour of the order whose limit is being
+// applied: a green order's price is rounded down and a red order's price is
+// rounded up, and whatever an order gives during a swap is rounded down. Both
+// legs of a swap are derived from the same integer, so the amount one order
+// gives is exactly the amount the other receives.
+type Rounding int
+
+const (
+	RoundDown Rounding = iota
+	RoundUp
+)
+
+// Parse converts a decimal string such as "65000.01" into an amount scaled by
+// the currency precision. Digits beyond the precision of the currency are
+// rejected instead of being rounded away. An empty string is read as zero.
+func (c *Currency) Parse(s string) (uint64, *MarketError) {
+	if s == "" {
+		return 0, nil
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	frac = strings.TrimRight(frac, "0")
+	if whole == "" || !isDigits(whole) || !isDigits(frac) || len(frac) > int(c.Decimal) {
+		return 0, newError(ErrInvalidAmount, "amount %q is not a %s amount with %d decimals", s, c.Name, c.Decimal)
+	}
+	frac += strings.Repeat("0", int(c.Decimal)-len(frac))
+	amount, err := strconv.ParseUint(whole+frac, 10, 64)
+	if err != nil {
+		return 0, newError(ErrInvalidAmount, "amount %q of %s is out of range", s, c.Name)
+	}
+	return amount, nil
+}
+
+// Format is the inverse of Parse.
+func (c *Currency) Format(amount uint64) string {
+	s := strconv.FormatUint(amount, 10)
+	if c.Decimal == 0 {
+		return s
+	}
+	if len(s) <= int(c.Decimal) {
+		s = strings.Repeat("0", int(c.Decimal)-len(s)+1) + s
+	}
+	point := len(s) - int(c.Decimal)
+	return s[:point] + "." + s[point:]
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// calcPrice returns the amount of currency2 for one currency1 scaled by
+// f1 * f2, the fractions of both currencies. amount1 is already scaled by f1
+// and amount2 by f2, so that is amount2 * f1 * f1 / amount1, and the unit
+// the conversions below divide by is f1 * f1.
+func (p *Pair) calcPrice(amount1 uint64, amount2 uint64, rounding Rounding) (uint64, bool) {
+	return mulDiv(amount2, p.unit, amount1, rounding)
+}
+
+// toCurrency2 returns how much currency2 amount1 of currency1 is worth at price.
+func (p *Pair) toCurrency2(amount1 uint64, price uint64, rounding Rounding) (uint64, bool) {
+	var num big.Int
+	num.SetUint64(amount1)
+	num.Mul(&num, new(big.Int).SetUint64(price))
+	return divide(&num, p.unit, rounding)
+}
+
+// toCurrency1 returns how much currency1 amount2 of currency2 buys at price.
+func (p *Pair) toCurrency1(amount2 uint64, price uint64, rounding Rounding) (uint64, bool) {
+	return mulDiv(amount2, p.unit, price, rounding)
+}
+
+// productLess tells whether a*b < c*d, without overflow.
+func productLess(a uint64, b uint64, c uint64, d uint64) bool {
+	var x, y big.Int
+	x.Mul(new(big.Int).SetUint64(a), new(big.Int).SetUint64(b))
+	y.Mul(new(big.Int).SetUint64(c), new(big.Int).SetUint64(d))
+	return x.Cmp(&y) < 0
+}
+
+func mulDiv(x uint64, y *big.Int, d uint64, rounding Rounding) (uint64, bool) {
+	if d == 0 {
+		return 0, false
+	}
+	var num big.Int
+	num.SetUint64(x)
+	num.Mul(&num, y)
+	return divide(&num, new(big.Int).SetUint64(d), rounding)
+}
+
+// divide returns num/den rounded as requested. ok is false when the result
+// does not fit in uint64.
+func divide(num *big.Int, den *big.Int, rounding Rounding) (uint64, bool) {
+	var quo, rem big.Int
+	quo.QuoRem(num, den, &rem)
+	if rounding == RoundUp && rem.Sign() != 0 {
+		quo.Add(&quo, big.NewInt(1))
+	}
+	if !quo.IsUint64() {
+		return 0, false
+	}
+	return quo.Uint64(), true
+}
@@ -0,0 +1,81 @@
+package reactor
+
+import (
+	"testing"
+)
+
+func TestParseFormat(t *testing.T) {
+	usd := Currency{Name: "USD", Decimal: 2, fraction: 100}
+	aaa := Currency{Name: "AAA", Decimal: 0, fraction: 1}
+	tests := []struct {
+		currency *Currency
+		s        string
+		amount   uint64
+		err      bool
+		format   string
+	}{
+		{&usd, "65000.01", 6500001, false, "65000.01"},
+		{&usd, "65000.1", 6500010, false, "65000.10"},
+		{&usd, "65000", 6500000, false, "65000.00"},
+		{&usd, "0.01", 1, false, "0.01"},
+		{&usd, "0.010", 1, false, "0.01"},
+		{&usd, "0", 0, false, "0.00"},
+		{&usd, "", 0, false, "0.00"},
+		{&usd, "65000.001", 0, true, ""},
+		{&usd, ".5", 0, true, ""},
+		{&usd, "-1", 0, true, ""},
+		{&usd, "1e3", 0, true, ""},
+		{&usd, "184467440737095516.16", 0, true, ""},
+		{&usd, "184467440737095516.15", 18446744073709551615, false, "184467440737095516.15"},
+		{&aaa, "12", 12, false, "12"},
+		{&aaa, "12.0", 12, false, "12"},
+		{&aaa, "12.5", 0, true, ""},
+	}
+	for _, test := range tests {
+		amount, err := test.currency.Parse(test.s)
+		if (err != nil) != test.err || amount != test.amount {
+			t.Errorf("%s.Parse(%q) = %d, %v, want %d", test.currency.Name, test.s, amount, err, test.amount)
+			continue
+		}
+		if err == nil {
+			if s := test.currency.Format(amount); s != test.format {
+				t.Errorf("%s.Format(%d) = %q, want %q", test.currency.Name, amount, s, test.format)
+			}
+		}
+	}
+}
+
+func TestPriceRounding(t *testing.T) {
+	m := CreateMarket()
+	m.AddCurrency("BTC", 8)
+	m.AddCurrency("USD", 2)
+	pair, _ := m.AddPair("BTC", "USD")
+
+	// 0.00000003 BTC for 0.02 USD is 666666.66... USD for one BTC.
+	down, _, _ := calcPrice(pair, true, 3, 2)
+	up, _, _ := calcPrice(pair, false, 3, 2)
+	if down != 6666666666666666 || up != 6666666666666667 {
+		t.Fatalf("green price %d and red price %d, want the exact price rounded down and up", down, up)
+	}
+	// 1 BTC for 65000.01 USD is exact either way.
+	green, _, _ := calcPrice(pair, true, 100000000, 6500001)
+	red, _, _ := calcPrice(pair, false, 100000000, 6500001)
+	if green != 6500001*1e8 || red != green {
+		t.Fatalf("65000.01 USD for 1 BTC priced %d and %d", green, red)
+	}
+
+	// Both legs are rounded down: 1 satoshi at 65000.01 is worth 0.00065...
+	// USD, and 0.01 USD buys 15.38... satoshi.
+	if got, _ := pair.toCurrency2(1, green, RoundDown); got != 0 {
+		t.Fatalf("1 satoshi is worth %d cents", got)
+	}
+	if got, _ := pair.toCurrency2(100000000, green, RoundDown); got != 6500001 {
+		t.Fatalf("1 BTC is worth %d cents at 65000.01", got)
+	}
+	if got, _ := pair.toCurrency1(1, green, RoundDown); got != 15 {
+		t.Fatalf("1 cent buys %d satoshi at 65000.01", got)
+	}
+	if _, ok := pair.toCurrency2(1<<63, 1<<63, RoundDown); ok {
+		t.Fatal("overflowing amount reported no error")
+	}
+}
@@ -0,0 +1,174 @@
+package reactor
+
+import "container/list"
+
+const maxLevelHeight = 24
+
+// book is one side of a pair. Price levels are kept in a skiplist ordered from
+// the best price to the worst and every level is a FIFO queue of its orders.
+// Orders only ever join the back of a queue, in the order the market numbered
+// them, so the front of the first level is always the order with the best
+// price and the lowest Seq.
+//
+// A new price level costs O(log P) for P levels, an order joining an existing
+// level and a cancel cost O(1), plus O(log P) when the cancel empties its
+// level. Every level keeps the totals of its orders as they join, trade and
+// leave, so reading it is O(1) as well.
+type book struct {
+	better func(a uint64, b uint64) bool
+	head   priceLevel
+	levels map[uint64]*priceLevel
+	height int
+	length int
+	seed   uint64
+}
+
+type priceLevel struct {
+	price   uint64
+	orders  list.List
+	next    []*priceLevel
+	amount1 uint64
+	amount2 uint64
+}
+
+func newBook(better func(a uint64, b uint64) bool) *book {
+	b := book{
+		better: better,
+		levels: make(map[uint64]*priceLevel),
+		height: 1,
+		seed:   0x9e3779b97f4a7c15,
+	}
+	b.head.next = make([]*priceLevel, maxLevelHeight)
+	return &b
+}
+
+// newBuyBook puts the highest price first, newSellBook the lowest.
+func newBuyBook() *book {
+	return newBook(func(a uint64, b uint64) bool { return a > b })
+}
+
+func newSellBook() *book {
+	return newBook(func(a uint64, b uint64) bool { return a < b })
+}
+
+func (b *book) len() int {
+	return b.length
+}
+
+// best returns the order with the highest priority or nil for an empty book.
+func (b *book) best() *Order {
+	first := b.head.next[0]
+	if first == nil {
+		return nil
+	}
+	return first.orders.Front().Value.(*Order)
+}
+
+func (b *book) add(o *Order) {
+	level, exists := b.levels[o.Price]
+	if !exists {
+		level = b.insertLevel(o.Price)
+	}
+	o.level = level
+	o.elem = level.orders.PushBack(o)
+	level.count(o)
+	b.length++
+}
+
+func (b *book) remove(o *Order) {
+	if o.level == nil {
+		return
+	}
+	level := o.level
+	level.uncount(o)
+	level.orders.Remove(o.elem)
+	o.level, o.elem = nil, nil
+	b.length--
+	if level.orders.Len() == 0 {
+		b.deleteLevel(level)
+	}
+}
+
+// eachLevel walks the price levels from the best one until fn returns false.
+func (b *book) eachLevel(fn func(level *priceLevel) bool) {
+	for level := b.head.next[0]; level != nil; level = level.next[0] {
+		if !fn(level) {
+			return
+		}
+	}
+}
+
+// each walks the orders in priority order until fn returns false.
+func (b *book) each(fn func(o *Order) bool) {
+	b.eachLevel(func(level *priceLevel) bool {
+		for e := level.orders.Front(); e != nil; e = e.Next() {
+			if !fn(e.Value.(*Order)) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// path fills update with the last level before price on every lane.
+func (b *book) path(price uint64, update []*priceLevel) {
+	x := &b.head
+	for i := b.height - 1; i >= 0; i-- {
+		for x.next[i] != nil && b.better(x.next[i].price, price) {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+}
+
+func (b *book) insertLevel(price uint64) *priceLevel {
+	var update [maxLevelHeight]*priceLevel
+	b.path(price, update[:])
+
+	height := b.randomHeight()
+	if height > b.height {
+		for i := b.height; i < height; i++ {
+			update[i] = &b.head
+		}
+		b.height = height
+	}
+
+	level := &priceLevel{
+		price: price,
+		next:  make([]*priceLevel, height),
+	}
+	for i := 0; i < height; i++ {
+		level.next[i] = update[i].next[i]
+		update[i].next[i] = level
+	}
+	b.levels[price] = level
+	return level
+}
+
+func (b *book) deleteLevel(level *priceLevel) {
+	var update [maxLevelHeight]*priceLevel
+	b.path(level.price, update[:])
+
+	for i := 0; i < len(level.next); i++ {
+		if update[i].next[i] == level {
+			update[i].next[i] = level.next[i]
+		}
+	}
+	for b.height > 1 && b.head.next[b.height-1] == nil {
+		b.height--
+	}
+	delete(b.levels, level.price)
+}
+
+// randomHeight draws level heights from a xorshift generator with a fixed
+// seed, so a book is laid out the same way every time it is built.
+func (b *book) randomHeight() int {
+	b.seed ^= b.seed << 13
+	b.seed ^= b.seed >> 7
+	b.seed ^= b.seed << 17
+	height := 1
+	for r := b.seed; height < maxLevelHeight && r&3 == 0; r >>= 2 {
+		height++
+	}
+	return height
+}
@@ -0,0 +1,181 @@
+package reactor
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestBookPriority(t *testing.T) {
+	b := newSellBook()
+	orders := []*Order{{Id: 1, Price: 10}, {Id: 2, Price: 10}, {Id: 3, Price: 9}, {Id: 4, Price: 10}, {Id: 5, Price: 11}}
+	for _, o := range orders {
+		b.add(o)
+	}
+	ids := func() []uint64 {
+		var list []uint64
+		b.each(func(o *Order) bool {
+			list = append(list, o.Id)
+			return true
+		})
+		return list
+	}
+	if got := fmt.Sprint(ids()); got != "[3 1 2 4 5]" {
+		t.Fatalf("orders in priority %s, want [3 1 2 4 5]", got)
+	}
+
+	b.remove(orders[0])
+	b.remove(orders[2])
+	if got := fmt.Sprint(ids()); got != "[2 4 5]" {
+		t.Fatalf("orders in priority after removals %s, want [2 4 5]", got)
+	}
+	if best := b.best(); best != orders[1] {
+		t.Fatalf("best order is %d, want 2", best.Id)
+	}
+	b.remove(orders[0])
+	if b.len() != 3 || len(b.levels) != 2 {
+		t.Fatalf("book has %d orders on %d levels, want 3 on 2", b.len(), len(b.levels))
+	}
+}
+
+// TestBookRandom adds and removes random orders and compares the book with
+// the orders it should hold, sorted by price and then by arrival.
+func TestBookRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	b := newBuyBook()
+	var resting []*Order
+	for id := uint64(1); id <= 5000; id++ {
+		if len(resting) > 0 && r.Intn(3) == 0 {
+			i := r.Intn(len(resting))
+			b.remove(resting[i])
+			resting = append(resting[:i], resting[i+1:]...)
+			continue
+		}
+		o := &Order{Id: id, Price: uint64(r.Intn(100))}
+		b.add(o)
+		resting = append(resting, o)
+	}
+
+	var previous *Order
+	count := 0
+	b.each(func(o *Order) bool {
+		if previous != nil && (o.Price > previous.Price || o.Price == previous.Price && o.Id < previous.Id) {
+			t.Fatalf("order %d at %d follows order %d at %d", o.Id, o.Price, previous.Id, previous.Price)
+		}
+		previous = o
+		count++
+		return true
+	})
+	if count != len(resting) || b.len() != len(resting) {
+		t.Fatalf("book walks %d orders and counts %d, want %d", count, b.len(), len(resting))
+	}
+}
+
+func TestTimePriority(t *testing.T) {
+	m := CreateMarket()
+	m.SetInvariantMode(InvariantPanic)
+	m.AddCurrency("AAA", 0)
+	m.AddCurrency("BBB", 0)
+	pair, _ := m.AddPair("AAA", "BBB")
+	m.AddNewOrder(1, "", "AAA/BBB", false, 10, 1000)
+	m.AddNewOrder(2, "", "AAA/BBB", false, 10, 1000)
+	m.AddNewOrder(3, "", "AAA/BBB", false, 10, 900)
+	m.AddNewOrder(4, "", "AAA/BBB", true, 15, 1500)
+
+	if seq := m.orderMap[4].Seq; seq != 4 {
+		t.Fatalf("fourth order got seq %d", seq)
+	}
+	if !m.orderMap[3].IsClose {
+		t.Fatal("the order with the better price was not filled first")
+	}
+	first, second := m.orderMap[1], m.orderMap[2]
+	if pair.sellStack.best() != first || first.Supply.Amount != 5 || second.Supply.Amount != 10 {
+		t.Fatalf("order 1 has %d left and order 2 %d, want 5 left of the older order", first.Supply.Amount, second.Supply.Amount)
+	}
+}
+
+// benchmarkSizes are the numbers of resting orders the book benchmarks run
+// with.
+var benchmarkSizes = []int{10000, 100000, 1000000}
+
+// randomPrice spreads the resting orders over one level per ten orders.
+func randomPrice(r *rand.Rand, size int) uint64 {
+	return uint64(r.Intn(size/10)) + 1
+}
+
+// BenchmarkBook places one order into a buy book that already holds size
+// resting orders and takes it out again.
+func BenchmarkBook(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		r := rand.New(rand.NewSource(1))
+		book := newBuyBook()
+		for i := 0; i < size; i++ {
+			book.add(&Order{Price: randomPrice(r, size)})
+		}
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				o := &Order{Price: randomPrice(r, size)}
+				book.add(o)
+				book.remove(o)
+			}
+		})
+	}
+}
+
+// BenchmarkSliceStack is BenchmarkBook for the sorted slice pairs kept their
+// orders in before price levels.
+func BenchmarkSliceStack(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		r := rand.New(rand.NewSource(1))
+		stack := make(sliceStack, size)
+		for i := range stack {
+			stack[i] = &Order{Price: randomPrice(r, size)}
+		}
+		sort.SliceStable(stack, func(i, j int) bool { return stack[i].Price > stack[j].Price })
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				o := &Order{Price: randomPrice(r, size)}
+				stack.add(o)
+				stack.remove(o)
+			}
+		})
+	}
+}
+
+// sliceStack is the buy stack as pairs kept it before price levels.
+type sliceStack []*Order
+
+func (s *sliceStack) add(o *Order) {
+	stack := *s
+	stackLen := len(stack)
+	last := stackLen - 1
+	if stackLen < 1 || o.Price <= stack[last].Price {
+		stack = append(stack, o)
+	} else if o.Price > stack[0].Price {
+		stack = append(stack, stack[last])
+		copy(stack[1:], stack[:last])
+		stack[0] = o
+	} else {
+		for i := 1; i < stackLen; i++ {
+			if o.Price <= stack[i-1].Price && o.Price > stack[i].Price {
+				stack = append(stack, stack[last])
+				copy(stack[i+1:], stack[i:last])
+				stack[i] = o
+				break
+			}
+		}
+	}
+	*s = stack
+}
+
+func (s *sliceStack) remove(o *Order) {
+	stack := *s
+	for i, order := range stack {
+		if order == o {
+			copy(stack[i:], stack[i+1:])
+			*s = stack[:len(stack)-1]
+			break
+		}
+	}
+}
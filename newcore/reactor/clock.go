@@ -0,0 +1,37 @@
+package reactor
+
+import "time"
+
+// Clock tells the market the time in Unix nanoseconds. Events, orders and
+// expiries all take their time from the clock of their market.
+type Clock interface {
+	Now() int64
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() int64 {
+	return time.Now().UnixNano()
+}
+
+// FakeClock is a Clock for tests, simulations and replays. It stands still
+// until it is set or advanced.
+type FakeClock struct {
+	now int64
+}
+
+func NewFakeClock(now int64) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() int64 {
+	return c.now
+}
+
+func (c *FakeClock) Set(now int64) {
+	c.now = now
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.now += int64(d)
+}
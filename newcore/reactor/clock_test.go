@@ -0,0 +1,36 @@
+package reactor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	m, clock := newTestMarket(t)
+	tr := newTranscript(t)
+
+	tr.step("sell 10 for 100 at 1000").record(m.AddNewOrder(1, "a", testPair, false, 10, 100))
+	clock.Advance(time.Second)
+	events, _ := tr.step("buy 5 for 50 a second later").record(m.AddNewOrder(2, "b", testPair, true, 5, 50))
+	for _, e := range events {
+		if e.Time != clock.Now() {
+			t.Fatalf("event %d at %d, want %d", e.Id, e.Time, clock.Now())
+		}
+	}
+	if order := m.orderMap[1]; order.Time != 1000 {
+		t.Fatalf("order 1 created at %d, want 1000", order.Time)
+	}
+	clock.Set(int64(time.Hour))
+	tr.step("cancel an hour later").record(m.CancelOrder(1))
+	tr.check("clock")
+
+	before := time.Now().UnixNano()
+	m = CreateMarket()
+	m.AddCurrency("AAA", 0)
+	m.AddCurrency("BBB", 0)
+	m.AddPair("AAA", "BBB")
+	events, _ = m.AddNewOrder(1, "a", testPair, false, 10, 100)
+	if events[0].Time < before || events[0].Time > time.Now().UnixNano() {
+		t.Fatalf("market without a clock stamped its event %d", events[0].Time)
+	}
+}
@@ -0,0 +1,69 @@
+package reactor
+
+type Side string
+
+const (
+	Bid Side = "bid"
+	Ask Side = "ask"
+)
+
+// Delta is the new aggregated state of one price level after a command. A
+// level with no orders left has been removed from the book. Seq grows by one
+// with every delta of the pair, and Depth and Book carry the Seq of the last
+// delta they include, so a mirror can start from Depth(pair, 0), apply the
+// deltas that follow it and notice any gap.
+type Delta struct {
+	Pair string `json:"pair"`
+	Seq  uint64 `json:"seq"`
+	Side Side   `json:"side"`
+	PriceLevel
+}
+
+type levelKey struct {
+	pair    *Pair
+	isGreen bool
+	price   uint64
+}
+
+// touch remembers that the price level of the order changed.
+func (o *Order) touch() {
+	m := o.market
+	key := levelKey{pair: o.pair, isGreen: o.IsGreen, price: o.Price}
+	if m.touched[key] {
+		return
+	}
+	m.touched[key] = true
+	m.touchedOrder = append(m.touchedOrder, key)
+}
+
+// flushDeltas emits one BookDelta event per level touched by the command, in
+// the order the levels were first touched.
+func (m *Market) flushDeltas() {
+	for _, key := range m.touchedOrder {
+		stack, side := key.pair.sellStack, Ask
+		if key.isGreen {
+			stack, side = key.pair.buyStack, Bid
+		}
+		level := PriceLevel{Price: key.price}
+		if l, exists := stack.levels[key.price]; exists {
+			level = l.aggregate()
+		}
+		key.pair.seq++
+
+		m.lastEventId++
+		event := Event{
+			Id:        m.lastEventId,
+			Time:      m.now(),
+			EventType: BookDelta,
+			Delta: &Delta{
+				Pair:       key.pair.Name(),
+				Seq:        key.pair.seq,
+				Side:       side,
+				PriceLevel: level,
+			},
+		}
+		m.lastEvents = append(m.lastEvents, event)
+		delete(m.touched, key)
+	}
+	m.touchedOrder = m.touchedOrder[:0]
+}
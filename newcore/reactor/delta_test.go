@@ -0,0 +1,92 @@
+package reactor
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mirror is a copy of the depth of a pair kept up to date with book deltas
+// alone, the way a client of the stream keeps it.
+type mirror struct {
+	seq    uint64
+	levels map[Side]map[uint64]PriceLevel
+}
+
+func newMirror(depth *Depth) *mirror {
+	m := mirror{
+		seq:    depth.Seq,
+		levels: map[Side]map[uint64]PriceLevel{Bid: {}, Ask: {}},
+	}
+	for _, level := range depth.Bids {
+		m.levels[Bid][level.Price] = level
+	}
+	for _, level := range depth.Asks {
+		m.levels[Ask][level.Price] = level
+	}
+	return &m
+}
+
+func (m *mirror) apply(t *testing.T, delta *Delta) {
+	t.Helper()
+	if delta.Seq != m.seq+1 {
+		t.Fatalf("delta %d follows %d", delta.Seq, m.seq)
+	}
+	m.seq = delta.Seq
+	if delta.Orders == 0 {
+		delete(m.levels[delta.Side], delta.Price)
+	} else {
+		m.levels[delta.Side][delta.Price] = delta.PriceLevel
+	}
+}
+
+func TestDeltaMirror(t *testing.T) {
+	m, clock := newTestMarket(t)
+	r := rand.New(rand.NewSource(1))
+	depth, _ := m.Depth(testPair, 0)
+	mirror := newMirror(depth)
+
+	for id := uint64(1); id <= 2000; id++ {
+		clock.Advance(time.Second)
+		var events []Event
+		switch n := r.Intn(20); {
+		case n < 3:
+			events, _ = m.CancelOrder(uint64(r.Int63n(int64(id))) + 1)
+		case n < 4:
+			events, _ = m.Expire()
+		default:
+			isGreen := r.Intn(2) == 0
+			amount1 := uint64(r.Intn(20) + 1)
+			amount2 := amount1 * uint64(90+r.Intn(21))
+			var options []OrderOption
+			switch r.Intn(6) {
+			case 0:
+				options = append(options, WithTimeInForce(ImmediateOrCancel))
+			case 1:
+				expireTime := clock.Now() + int64(r.Intn(60)+1)*int64(time.Second)
+				options = append(options, WithTimeInForce(GoodTillDate), WithExpireTime(expireTime))
+			case 2:
+				if isGreen {
+					amount1 = 0
+				} else {
+					amount2 = 0
+				}
+			}
+			events, _ = m.AddNewOrder(id, "", testPair, isGreen, amount1, amount2, options...)
+		}
+		for _, e := range events {
+			if e.EventType == BookDelta {
+				mirror.apply(t, e.Delta)
+			}
+		}
+
+		depth, _ := m.Depth(testPair, 0)
+		if depth.Seq != mirror.seq {
+			t.Fatalf("command %d: depth is at seq %d, the deltas at %d", id, depth.Seq, mirror.seq)
+		}
+		if want := newMirror(depth); !reflect.DeepEqual(mirror.levels, want.levels) {
+			t.Fatalf("command %d: deltas give %v, depth is %v", id, mirror.levels, want.levels)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package reactor
+
+import "math"
+
+// PriceLevel aggregates the resting orders at one price. Amount1 is their
+// currency1 side (what bids want and asks supply), Amount2 their currency2
+// side (what bids supply and asks want).
+type PriceLevel struct {
+	Price   uint64 `json:"price"`
+	Amount1 uint64 `json:"amount1"`
+	Amount2 uint64 `json:"amount2"`
+	Orders  int    `json:"orders"`
+}
+
+// Depth is the aggregated (L2) view of a pair, best prices first. Seq is the
+// sequence number of the last book delta it includes.
+type Depth struct {
+	Pair string       `json:"pair"`
+	Seq  uint64       `json:"seq"`
+	Bids []PriceLevel `json:"bids"`
+	Asks []PriceLevel `json:"asks"`
+}
+
+// OrderBook is the full (L3) view of a pair: copies of the resting orders in
+// the order they will be matched.
+type OrderBook struct {
+	Pair string  `json:"pair"`
+	Seq  uint64  `json:"seq"`
+	Bids []Order `json:"bids"`
+	Asks []Order `json:"asks"`
+}
+
+// Depth returns up to levels price levels per side, all of them when levels
+// is not positive. The full depth is the snapshot book deltas apply to.
+func (m *Market) Depth(pairName string, levels int) (*Depth, error) {
+	pair, exists := m.pairMap[pairName]
+	if !exists {
+		return nil, newError(ErrUnknownPair, "pair %s not found", pairName)
+	}
+	depth := Depth{
+		Pair: pairName,
+		Seq:  pair.seq,
+		Bids: pair.buyStack.depth(levels),
+		Asks: pair.sellStack.depth(levels),
+	}
+	return &depth, nil
+}
+
+func (m *Market) Book(pairName string) (*OrderBook, error) {
+	pair, exists := m.pairMap[pairName]
+	if !exists {
+		return nil, newError(ErrUnknownPair, "pair %s not found", pairName)
+	}
+	book := OrderBook{
+		Pair: pairName,
+		Seq:  pair.seq,
+		Bids: pair.buyStack.orders(),
+		Asks: pair.sellStack.orders(),
+	}
+	return &book, nil
+}
+
+func (b *book) depth(levels int) []PriceLevel {
+	list := make([]PriceLevel, 0)
+	b.eachLevel(func(level *priceLevel) bool {
+		if levels > 0 && len(list) == levels {
+			return false
+		}
+		list = append(list, level.aggregate())
+		return true
+	})
+	return list
+}
+
+func (b *book) orders() []Order {
+	list := make([]Order, 0, b.len())
+	b.each(func(o *Order) bool {
+		list = append(list, *o)
+		return true
+	})
+	return list
+}
+
+// aggregate returns the running totals of the level.
+func (l *priceLevel) aggregate() PriceLevel {
+	return PriceLevel{
+		Price:   l.price,
+		Amount1: l.amount1,
+		Amount2: l.amount2,
+		Orders:  l.orders.Len(),
+	}
+}
+
+// sum adds up the orders of the level, except skip, the way the running
+// totals should.
+func (l *priceLevel) sum(skip *Order) (amount1 uint64, amount2 uint64) {
+	for e := l.orders.Front(); e != nil; e = e.Next() {
+		if o := e.Value.(*Order); o != skip {
+			a1, a2 := o.levelAmounts()
+			amount1, amount2 = addSaturated(amount1, a1), addSaturated(amount2, a2)
+		}
+	}
+	return amount1, amount2
+}
+
+// levelAmounts returns what the order adds to its level in both currencies.
+func (o *Order) levelAmounts() (amount1 uint64, amount2 uint64) {
+	if o.IsGreen {
+		return o.Want.Amount, o.Supply.Amount
+	}
+	return o.Supply.Amount, o.Want.Amount
+}
+
+// count adds the order to the totals of the level.
+func (l *priceLevel) count(o *Order) {
+	a1, a2 := o.levelAmounts()
+	l.amount1, l.amount2 = addSaturated(l.amount1, a1), addSaturated(l.amount2, a2)
+}
+
+// uncount takes the order, still queued at the level, out of its totals. A
+// saturated total has lost what it was made of and is added up again.
+func (l *priceLevel) uncount(o *Order) {
+	if l.amount1 == math.MaxUint64 || l.amount2 == math.MaxUint64 {
+		l.amount1, l.amount2 = l.sum(o)
+		return
+	}
+	a1, a2 := o.levelAmounts()
+	l.amount1 -= a1
+	l.amount2 -= a2
+}
+
+// addSaturated keeps totals too large for a uint64 at math.MaxUint64.
+func addSaturated(a uint64, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
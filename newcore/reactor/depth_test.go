@@ -0,0 +1,56 @@
+package reactor
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDepth(t *testing.T) {
+	m := CreateMarket()
+	m.AddCurrency("AAA", 0)
+	m.AddCurrency("BBB", 0)
+	m.AddPair("AAA", "BBB")
+	m.AddNewOrder(1, "a", "AAA/BBB", false, 10, 110)
+	m.AddNewOrder(2, "a", "AAA/BBB", false, 5, 55)
+	m.AddNewOrder(3, "a", "AAA/BBB", false, 10, 120)
+	m.AddNewOrder(4, "b", "AAA/BBB", true, 10, 90)
+	m.AddNewOrder(5, "b", "AAA/BBB", true, 10, 100)
+
+	depth, err := m.Depth("AAA/BBB", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Depth{
+		Pair: "AAA/BBB",
+		Seq:  5,
+		Bids: []PriceLevel{{Price: 10, Amount1: 10, Amount2: 100, Orders: 1}, {Price: 9, Amount1: 10, Amount2: 90, Orders: 1}},
+		Asks: []PriceLevel{{Price: 11, Amount1: 15, Amount2: 165, Orders: 2}, {Price: 12, Amount1: 10, Amount2: 120, Orders: 1}},
+	}
+	if !reflect.DeepEqual(*depth, want) {
+		t.Fatalf("depth is %+v, want %+v", *depth, want)
+	}
+	if depth, _ := m.Depth("AAA/BBB", 1); len(depth.Bids) != 1 || len(depth.Asks) != 1 || depth.Asks[0].Price != 11 {
+		t.Fatalf("one level of depth is %+v", depth)
+	}
+
+	book, _ := m.Book("AAA/BBB")
+	var asks []uint64
+	for _, o := range book.Asks {
+		asks = append(asks, o.Id)
+	}
+	if !reflect.DeepEqual(asks, []uint64{1, 2, 3}) || len(book.Bids) != 2 || book.Bids[0].Id != 5 {
+		t.Fatalf("book is %+v", book)
+	}
+	book.Asks[0].Supply.Amount = 0
+	if m.orderMap[1].Supply.Amount != 10 {
+		t.Fatal("book returned the resting order instead of a copy")
+	}
+
+	if _, err := m.Depth("AAA/CCC", 0); !errors.Is(err, ErrUnknownPair) {
+		t.Fatalf("depth of an unknown pair got %v", err)
+	}
+	if _, err := m.Book("AAA/CCC"); !errors.Is(err, ErrUnknownPair) {
+		t.Fatalf("book of an unknown pair got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package reactor
+
+import "fmt"
+
+// ErrorCode identifies why the market refused a request. Codes are errors
+// themselves, so callers can test a returned error with errors.Is.
+type ErrorCode string
+
+const (
+	ErrDuplicateCurrency  ErrorCode = "duplicate_currency"
+	ErrInvalidCurrency    ErrorCode = "invalid_currency"
+	ErrUnknownCurrency    ErrorCode = "unknown_currency"
+	ErrDuplicatePair      ErrorCode = "duplicate_pair"
+	ErrInvalidPair        ErrorCode = "invalid_pair"
+	ErrUnknownPair        ErrorCode = "unknown_pair"
+	ErrDuplicateOrder     ErrorCode = "duplicate_order"
+	ErrUnknownOrder       ErrorCode = "unknown_order"
+	ErrOrderClosed        ErrorCode = "order_closed"
+	ErrInvalidAmount      ErrorCode = "invalid_amount"
+	ErrInvariant          ErrorCode = "invariant"
+	ErrInvalidSnapshot    ErrorCode = "invalid_snapshot"
+	ErrNoAccounts         ErrorCode = "no_accounts"
+	ErrInvalidAccount     ErrorCode = "invalid_account"
+	ErrInsufficientFunds  ErrorCode = "insufficient_funds"
+	ErrInvalidTransfer    ErrorCode = "invalid_transfer"
+	ErrDuplicateTransfer  ErrorCode = "duplicate_transfer"
+	ErrInvalidFees        ErrorCode = "invalid_fees"
+	ErrInvalidTimeInForce ErrorCode = "invalid_time_in_force"
+	ErrNotFillable        ErrorCode = "not_fillable"
+	ErrInvalidSlippage    ErrorCode = "invalid_slippage"
+)
+
+func (c ErrorCode) Error() string {
+	return string(c)
+}
+
+// MarketError is returned by the Market API and carried by Error events.
+type MarketError struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func newError(code ErrorCode, format string, a ...interface{}) *MarketError {
+	return &MarketError{
+		Code:    code,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+func (e *MarketError) Error() string {
+	return e.Message
+}
+
+func (e *MarketError) Unwrap() error {
+	return e.Code
+}
@@ -0,0 +1,48 @@
+package reactor
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	m := CreateMarket()
+	m.AddCurrency("BTC", 8)
+	m.AddCurrency("USD", 2)
+	m.AddPair("BTC", "USD")
+	m.AddNewOrderString(1, "", "BTC/USD", false, "1", "65000")
+
+	tests := []struct {
+		name string
+		run  func() ([]Event, error)
+		code ErrorCode
+	}{
+		{"duplicate order", func() ([]Event, error) { return m.AddNewOrderString(1, "", "BTC/USD", true, "1", "65000") }, ErrDuplicateOrder},
+		{"unknown pair", func() ([]Event, error) { return m.AddNewOrderString(2, "", "ETH/USD", true, "1", "65000") }, ErrUnknownPair},
+		{"too many decimals", func() ([]Event, error) { return m.AddNewOrderString(2, "", "BTC/USD", true, "1", "65000.001") }, ErrInvalidAmount},
+		{"no amounts", func() ([]Event, error) { return m.AddNewOrder(2, "", "BTC/USD", true, 10, 0) }, ErrInvalidAmount},
+		{"buy of nothing", func() ([]Event, error) { return m.AddNewOrder(2, "", "BTC/USD", true, 0, 0) }, ErrInvalidAmount},
+		{"sale of nothing", func() ([]Event, error) { return m.AddNewOrder(2, "", "BTC/USD", false, 0, 0) }, ErrInvalidAmount},
+		{"unknown order", func() ([]Event, error) { return m.CancelOrder(2) }, ErrUnknownOrder},
+	}
+	for _, test := range tests {
+		events, err := test.run()
+		if !errors.Is(err, test.code) {
+			t.Errorf("%s got %v, want %s", test.name, err, test.code)
+			continue
+		}
+		if len(events) != 1 || events[0].EventType != Error || events[0].Error != err {
+			t.Errorf("%s answered %+v, want one Error event carrying the error", test.name, events)
+		}
+	}
+
+	_, err := m.CancelOrder(2)
+	data, _ := json.Marshal(err)
+	if string(data) != `{"code":"unknown_order","message":"order 2 not found"}` {
+		t.Fatalf("error marshals as %s", data)
+	}
+	if _, ok := m.orderMap[2]; ok {
+		t.Fatal("refused order was kept")
+	}
+}
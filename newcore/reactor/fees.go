@@ -0,0 +1,100 @@
+package reactor
+
+import "math/big"
+
+// FeeScale is the unit of fee rates: a rate of 1000 is 0.1% of the amount.
+const FeeScale = 1000000
+
+// HouseAccount is the account fees are credited to when the market keeps
+// accounts. The name is reserved: clients cannot transfer to or from it, nor
+// place orders as it.
+const HouseAccount = "house"
+
+// FeeTier replaces the base rates for accounts that have traded at least
+// Volume of currency2 on the pair.
+type FeeTier struct {
+	Volume uint64 `json:"volume"`
+	Maker  uint64 `json:"maker"`
+	Taker  uint64 `json:"taker"`
+}
+
+// FeeSchedule holds the fee rates of a pair. The taker is the order that came
+// in and crossed the book, the maker the resting order it matched. Each side
+// pays its fee out of what it receives, rounded down. Tiers are sorted by
+// Volume and the last one an account reached applies to it.
+type FeeSchedule struct {
+	Maker uint64    `json:"maker"`
+	Taker uint64    `json:"taker"`
+	Tiers []FeeTier `json:"tiers,omitempty"`
+}
+
+// SetFees replaces the fee schedule of a pair. It applies to the swaps that
+// follow.
+func (m *Market) SetFees(pairName string, fees FeeSchedule) error {
+	pair, exists := m.pairMap[pairName]
+	if !exists {
+		return newError(ErrUnknownPair, "pair %s not found", pairName)
+	}
+	if fees.Maker > FeeScale || fees.Taker > FeeScale {
+		return newError(ErrInvalidFees, "fee rates above %d not allowed", FeeScale)
+	}
+	for i, tier := range fees.Tiers {
+		if tier.Maker > FeeScale || tier.Taker > FeeScale {
+			return newError(ErrInvalidFees, "fee rates above %d not allowed", FeeScale)
+		}
+		if i > 0 && tier.Volume <= fees.Tiers[i-1].Volume {
+			return newError(ErrInvalidFees, "fee tiers must be sorted by volume")
+		}
+	}
+	fees.Tiers = append([]FeeTier(nil), fees.Tiers...)
+	pair.fees = &fees
+	return nil
+}
+
+// rate returns the fee rate of an order of owner on the pair.
+func (p *Pair) rate(owner string, isTaker bool) uint64 {
+	if p.fees == nil {
+		return 0
+	}
+	maker, taker := p.fees.Maker, p.fees.Taker
+	volume := p.volumes[owner]
+	for _, tier := range p.fees.Tiers {
+		if volume < tier.Volume {
+			break
+		}
+		maker, taker = tier.Maker, tier.Taker
+	}
+	if isTaker {
+		return taker
+	}
+	return maker
+}
+
+// chargeFees takes the fee of each order out of the money it received in the
+// swap and counts the swap towards the volume of both owners.
+func (p *Pair) chargeFees(s *Swap) {
+	greenIsTaker := s.greenIsTaker()
+	s.Taker = s.Red.Id
+	if greenIsTaker {
+		s.Taker = s.Green.Id
+	}
+	s.Fee1 = fee(s.Money1, p.rate(s.Green.Owner, greenIsTaker))
+	s.Fee2 = fee(s.Money2, p.rate(s.Red.Owner, !greenIsTaker))
+	s.Green.Received.Amount -= s.Fee1
+	s.Red.Received.Amount -= s.Fee2
+	p.market.fees[p.currency1.Name] += s.Fee1
+	p.market.fees[p.currency2.Name] += s.Fee2
+
+	p.volumes[s.Green.Owner] = addSaturated(p.volumes[s.Green.Owner], s.Money2)
+	if s.Red.Owner != s.Green.Owner {
+		p.volumes[s.Red.Owner] = addSaturated(p.volumes[s.Red.Owner], s.Money2)
+	}
+}
+
+func fee(amount uint64, rate uint64) uint64 {
+	if rate == 0 {
+		return 0
+	}
+	fee, _ := mulDiv(amount, new(big.Int).SetUint64(rate), FeeScale, RoundDown)
+	return fee
+}
@@ -0,0 +1,51 @@
+package reactor
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFees(t *testing.T) {
+	m, _ := newTestMarket(t, WithAccounts())
+	tr := newTranscript(t)
+
+	if err := m.SetFees(testPair, FeeSchedule{Maker: FeeScale + 1}); !errors.Is(err, ErrInvalidFees) {
+		t.Fatalf("fee above the scale got %v, want %v", err, ErrInvalidFees)
+	}
+	tiers := []FeeTier{{Volume: 2000, Maker: 1000, Taker: 2000}, {Volume: 1000, Maker: 0, Taker: 0}}
+	if err := m.SetFees(testPair, FeeSchedule{Tiers: tiers}); !errors.Is(err, ErrInvalidFees) {
+		t.Fatalf("unsorted tiers got %v, want %v", err, ErrInvalidFees)
+	}
+	// 1% for makers and 2% for takers, halved once an account traded 1000.
+	fees := FeeSchedule{Maker: 10000, Taker: 20000, Tiers: []FeeTier{{Volume: 1000, Maker: 5000, Taker: 10000}}}
+	if err := m.SetFees(testPair, fees); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.step("deposit 100 AAA to a").record(m.Deposit("tx1", "a", "AAA", 100))
+	tr.step("deposit 10000 BBB to b").record(m.Deposit("tx2", "b", "BBB", 10000))
+	tr.step("a sells 50 for 5000").record(m.AddNewOrder(1, "a", testPair, false, 50, 5000))
+
+	events, _ := tr.step("b buys 10 for 1000").record(m.AddNewOrder(2, "b", testPair, true, 10, 1000))
+	swap := findEvent(t, events, SwapOrder).Swap
+	if swap.Taker != 2 || swap.Fee1 != 0 || swap.Fee2 != 10 {
+		t.Fatalf("first swap charged taker %d fees %d and %d, want 0 AAA from b and 10 BBB from a", swap.Taker, swap.Fee1, swap.Fee2)
+	}
+
+	events, _ = tr.step("b buys 20 for 2000 at the lower tier").record(m.AddNewOrder(3, "b", testPair, true, 20, 2000))
+	swap = findEvent(t, events, SwapOrder).Swap
+	if swap.Fee1 != 0 || swap.Fee2 != 10 {
+		t.Fatalf("second swap charged fees %d and %d, want 0 AAA and 10 BBB", swap.Fee1, swap.Fee2)
+	}
+
+	if b := balance(t, m, "a", "BBB"); b.Available != 3000-10-10 {
+		t.Fatalf("a has %+v after selling 30 for 3000 less fees", b)
+	}
+	if b := balance(t, m, "b", "AAA"); b.Available != 30 {
+		t.Fatalf("b has %+v after buying 30", b)
+	}
+	if house := balance(t, m, HouseAccount, "BBB"); house.Available != 20 {
+		t.Fatalf("house has %+v, want the 20 BBB of fees", house)
+	}
+	tr.check("fees")
+}
@@ -0,0 +1,119 @@
+package reactor
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testPair is the pair of newTestMarket. Both currencies have no decimals, so
+// amounts in the golden files read as they are given.
+const testPair = "AAA/BBB"
+
+// newTestMarket returns a market with testPair that panics on any broken
+// invariant, and the fake clock it runs on.
+func newTestMarket(t *testing.T, options ...Option) (*Market, *FakeClock) {
+	clock := NewFakeClock(1000)
+	options = append([]Option{WithClock(clock), WithInvariantMode(InvariantPanic)}, options...)
+	m := CreateMarket(options...)
+	if _, err := m.AddCurrency("AAA", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddCurrency("BBB", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddPair("AAA", "BBB"); err != nil {
+		t.Fatal(err)
+	}
+	return m, clock
+}
+
+// transcript records the events of the commands of a test, one JSON object
+// per line under a comment line naming the command, and compares them with
+// testdata/<name>.golden. Run go test -update to rewrite the golden files.
+type transcript struct {
+	t   *testing.T
+	buf bytes.Buffer
+}
+
+func newTranscript(t *testing.T) *transcript {
+	return &transcript{t: t}
+}
+
+// step writes the comment line naming the command that follows.
+func (tr *transcript) step(command string) *transcript {
+	fmt.Fprintf(&tr.buf, "# %s\n", command)
+	return tr
+}
+
+// record writes the events and the error of a command and returns them.
+func (tr *transcript) record(events []Event, err error) ([]Event, error) {
+	if err != nil {
+		fmt.Fprintf(&tr.buf, "# error: %v\n", err)
+	}
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			tr.t.Fatal(err)
+		}
+		tr.buf.Write(line)
+		tr.buf.WriteByte('\n')
+	}
+	return events, err
+}
+
+func (tr *transcript) check(name string) {
+	tr.t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	got := tr.buf.Bytes()
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			tr.t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	if bytes.Equal(got, want) {
+		return
+	}
+	gotLines, wantLines := bytes.Split(got, []byte("\n")), bytes.Split(want, []byte("\n"))
+	for i := 0; i < len(gotLines) && i < len(wantLines); i++ {
+		if !bytes.Equal(gotLines[i], wantLines[i]) {
+			tr.t.Fatalf("%s differs at line %d:\ngot  %s\nwant %s", path, i+1, gotLines[i], wantLines[i])
+		}
+	}
+	tr.t.Fatalf("%s has %d lines, got %d", path, len(wantLines), len(gotLines))
+}
+
+// findEvent returns the first event of type eventType, failing the test when
+// there is none.
+func findEvent(t *testing.T, events []Event, eventType EventType) Event {
+	t.Helper()
+	for _, e := range events {
+		if e.EventType == eventType {
+			return e
+		}
+	}
+	t.Fatalf("no event of type %d in %+v", eventType, events)
+	return Event{}
+}
+
+// countEvents counts the events of type eventType.
+func countEvents(events []Event, eventType EventType) int {
+	n := 0
+	for _, e := range events {
+		if e.EventType == eventType {
+			n++
+		}
+	}
+	return n
+}
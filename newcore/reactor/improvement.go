@@ -0,0 +1,92 @@
+package reactor
+
+// ImprovementPolicy decides who gets the price improvement of a swap. When
+// a swap trades at one order's price, the other order gives up less than it
+// was prepared to; the difference leaves its supply as Remainder1 or
+// Remainder2 and is credited according to the policy.
+type ImprovementPolicy string
+
+const (
+	// ImproveHouse keeps the improvement for the exchange, the way the
+	// StockBonus of oldcore did. It is the default.
+	ImproveHouse ImprovementPolicy = "house"
+	// ImproveTaker gives it to the order that came in and crossed the book.
+	ImproveTaker ImprovementPolicy = "taker"
+	// ImproveMaker gives it to the resting order that was matched.
+	ImproveMaker ImprovementPolicy = "maker"
+)
+
+// Beneficiary names who a remainder of a swap was credited to.
+type Beneficiary string
+
+const (
+	BeneficiaryGreen Beneficiary = "green"
+	BeneficiaryRed   Beneficiary = "red"
+	BeneficiaryHouse Beneficiary = "house"
+)
+
+// WithImprovementPolicy sets who gets the price improvement of swaps.
+func WithImprovementPolicy(policy ImprovementPolicy) Option {
+	return func(m *Market) {
+		m.improvement = policy
+	}
+}
+
+func (s *Swap) greenIsTaker() bool {
+	return s.Green.Seq > s.Red.Seq
+}
+
+// creditRemainders credits the remainders of a swap to the beneficiary of the
+// improvement policy. The currency1 remainder comes out of the red supply: it
+// goes back to the red order as a refund or to the green order as extra
+// received money. The currency2 remainder comes out of the green supply the
+// same way. The house share is kept in the market remainders.
+func (p *Pair) creditRemainders(s *Swap) {
+	to := BeneficiaryHouse
+	switch p.market.improvement {
+	case ImproveTaker:
+		to = BeneficiaryRed
+		if s.greenIsTaker() {
+			to = BeneficiaryGreen
+		}
+	case ImproveMaker:
+		to = BeneficiaryGreen
+		if s.greenIsTaker() {
+			to = BeneficiaryRed
+		}
+	}
+
+	if s.Remainder1 > 0 {
+		s.Remainder1To = to
+		switch to {
+		case BeneficiaryGreen:
+			s.Green.Received.Amount += s.Remainder1
+		case BeneficiaryRed:
+			s.Red.Refunded += s.Remainder1
+		default:
+			p.market.remainders[p.currency1.Name] += s.Remainder1
+		}
+	}
+	if s.Remainder2 > 0 {
+		s.Remainder2To = to
+		switch to {
+		case BeneficiaryGreen:
+			s.Green.Refunded += s.Remainder2
+		case BeneficiaryRed:
+			s.Red.Received.Amount += s.Remainder2
+		default:
+			p.market.remainders[p.currency2.Name] += s.Remainder2
+		}
+	}
+}
+
+// beneficiary returns the account a remainder was credited to.
+func (s *Swap) beneficiary(to Beneficiary) string {
+	switch to {
+	case BeneficiaryGreen:
+		return s.Green.Owner
+	case BeneficiaryRed:
+		return s.Red.Owner
+	}
+	return HouseAccount
+}
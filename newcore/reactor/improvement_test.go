@@ -0,0 +1,55 @@
+package reactor
+
+import "testing"
+
+// TestImprovementPolicy trades one swap at the price of the resting order and
+// one at the price of the incoming order, and checks who is credited the
+// improvement under every policy.
+func TestImprovementPolicy(t *testing.T) {
+	// The resting order a sells 10 AAA at 10 and b buys 5 for 60: the swap
+	// is at 12 and a gives 1 AAA less than its supply allows. Or the resting
+	// order b buys 10 AAA at 12 and a sells 5 for 50: the swap is at 10 and b
+	// gives 10 BBB less.
+	tests := []struct {
+		policy  ImprovementPolicy
+		aSells  bool
+		to      Beneficiary
+		balance map[string][2]uint64
+	}{
+		{ImproveHouse, true, BeneficiaryHouse, map[string][2]uint64{"a": {90, 60}, "b": {5, 940}, HouseAccount: {1, 0}}},
+		{ImproveHouse, false, BeneficiaryHouse, map[string][2]uint64{"a": {95, 50}, "b": {5, 880}, HouseAccount: {0, 10}}},
+		{ImproveTaker, true, BeneficiaryGreen, map[string][2]uint64{"a": {90, 60}, "b": {6, 940}, HouseAccount: {0, 0}}},
+		{ImproveTaker, false, BeneficiaryRed, map[string][2]uint64{"a": {95, 60}, "b": {5, 880}, HouseAccount: {0, 0}}},
+		{ImproveMaker, true, BeneficiaryRed, map[string][2]uint64{"a": {91, 60}, "b": {5, 940}, HouseAccount: {0, 0}}},
+		{ImproveMaker, false, BeneficiaryGreen, map[string][2]uint64{"a": {95, 50}, "b": {5, 890}, HouseAccount: {0, 0}}},
+	}
+	for _, test := range tests {
+		m, _ := newTestMarket(t, WithAccounts(), WithImprovementPolicy(test.policy))
+		m.Deposit("tx1", "a", "AAA", 100)
+		m.Deposit("tx2", "b", "BBB", 1000)
+		var events []Event
+		var err error
+		if test.aSells {
+			m.AddNewOrder(1, "a", testPair, false, 10, 100)
+			events, err = m.AddNewOrder(2, "b", testPair, true, 5, 60)
+		} else {
+			m.AddNewOrder(1, "b", testPair, true, 10, 120)
+			events, err = m.AddNewOrder(2, "a", testPair, false, 5, 50)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		swap := findEvent(t, events, SwapOrder).Swap
+		if to := swap.Remainder1To + swap.Remainder2To; to != test.to {
+			t.Errorf("%s: improvement of %d and %d went to %q, want %q",
+				test.policy, swap.Remainder1, swap.Remainder2, to, test.to)
+		}
+		for owner, want := range test.balance {
+			got := [2]uint64{balance(t, m, owner, "AAA").Available, balance(t, m, owner, "BBB").Available}
+			if got != want {
+				t.Errorf("%s: %s has %v AAA and BBB available, want %v", test.policy, owner, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package reactor
+
+import (
+	"fmt"
+	"sort"
+)
+
+// InvariantMode switches on the conservation checks that run after every
+// AddNewOrder and CancelOrder. The checks walk every order of the market, so
+// they are meant for tests, simulations and audits rather than production.
+type InvariantMode int
+
+const (
+	InvariantOff InvariantMode = iota
+	// InvariantReport appends an Error event carrying the violations.
+	InvariantReport
+	// InvariantPanic panics with the violations instead, for tests.
+	InvariantPanic
+)
+
+// Violation describes one broken invariant as the expected and the actual
+// value of the checked quantity.
+type Violation struct {
+	Check    string `json:"check"`
+	Pair     string `json:"pair,omitempty"`
+	Order    uint64 `json:"order,omitempty"`
+	Currency string `json:"currency,omitempty"`
+	Expected uint64 `json:"expected"`
+	Actual   uint64 `json:"actual"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: pair %q order %d currency %q expected %d actual %d",
+		v.Check, v.Pair, v.Order, v.Currency, v.Expected, v.Actual)
+}
+
+type orderState struct {
+	supply   uint64
+	want     uint64
+	received uint64
+}
+
+func (m *Market) SetInvariantMode(mode InvariantMode) {
+	m.invariants = mode
+}
+
+func (o *Order) state() orderState {
+	return orderState{
+		supply:   o.Supply.Amount,
+		want:     o.Want.Amount,
+		received: o.Received.Amount,
+	}
+}
+
+func (m *Market) violation(v Violation) {
+	m.violations = append(m.violations, v)
+}
+
+// checkSwap verifies that the money of a swap is exactly what left the
+// supply of one order and arrived at the other, less the fee and plus any
+// remainder credited to it.
+func (m *Market) checkSwap(s *Swap, green orderState, red orderState) {
+	pairName := s.pair.Name()
+	check := func(check string, order *Order, currency string, expected uint64, actual uint64) {
+		if expected != actual {
+			m.violation(Violation{
+				Check:    check,
+				Pair:     pairName,
+				Order:    order.Id,
+				Currency: currency,
+				Expected: expected,
+				Actual:   actual,
+			})
+		}
+	}
+	currency1, currency2 := s.pair.currency1.Name, s.pair.currency2.Name
+
+	check("swap supply", s.Red, currency1, s.Money1+s.Remainder1, red.supply-s.Red.Supply.Amount)
+	check("swap supply", s.Green, currency2, s.Money2+s.Remainder2, green.supply-s.Green.Supply.Amount)
+	greenReceived, redReceived := s.Money1-s.Fee1, s.Money2-s.Fee2
+	if s.Remainder1To == BeneficiaryGreen {
+		greenReceived += s.Remainder1
+	}
+	if s.Remainder2To == BeneficiaryRed {
+		redReceived += s.Remainder2
+	}
+	check("swap received", s.Green, currency1, greenReceived, s.Green.Received.Amount-green.received)
+	check("swap received", s.Red, currency2, redReceived, s.Red.Received.Amount-red.received)
+	if !s.Green.IsMarketPrice {
+		check("swap want", s.Green, currency1, s.Money1, green.want-s.Green.Want.Amount)
+	}
+	if !s.Red.IsMarketPrice {
+		check("swap want", s.Red, currency2, s.Money2, red.want-s.Red.Want.Amount)
+	}
+}
+
+// checkBook verifies that the pair volumes are the supply of the resting
+// orders and that only open limit orders rest on the book, in price order.
+func (m *Market) checkBook(p *Pair) {
+	m.checkLevels(p, p.buyStack)
+	m.checkLevels(p, p.sellStack)
+
+	var volume1, volume2 uint64
+	p.sellStack.each(func(order *Order) bool {
+		volume1 += order.Supply.Amount
+		if order.IsClose {
+			m.violation(Violation{Check: "closed order on book", Pair: p.Name(), Order: order.Id})
+		}
+		if order.IsMarketPrice {
+			m.violation(Violation{Check: "market order on book", Pair: p.Name(), Order: order.Id})
+		}
+		return true
+	})
+	p.buyStack.each(func(order *Order) bool {
+		volume2 += order.Supply.Amount
+		if order.IsClose {
+			m.violation(Violation{Check: "closed order on book", Pair: p.Name(), Order: order.Id})
+		}
+		if order.IsMarketPrice {
+			m.violation(Violation{Check: "market order on book", Pair: p.Name(), Order: order.Id})
+		}
+		return true
+	})
+	if volume1 != p.curr1volume {
+		m.violation(Violation{Check: "book volume", Pair: p.Name(), Currency: p.currency1.Name,
+			Expected: volume1, Actual: p.curr1volume})
+	}
+	if volume2 != p.curr2volume {
+		m.violation(Violation{Check: "book volume", Pair: p.Name(), Currency: p.currency2.Name,
+			Expected: volume2, Actual: p.curr2volume})
+	}
+}
+
+func (m *Market) checkLevels(p *Pair, b *book) {
+	var previous *priceLevel
+	count := 0
+	b.eachLevel(func(level *priceLevel) bool {
+		if previous != nil && !b.better(previous.price, level.price) {
+			m.violation(Violation{Check: "book order", Pair: p.Name(),
+				Expected: previous.price, Actual: level.price})
+		}
+		var seq uint64
+		for e := level.orders.Front(); e != nil; e = e.Next() {
+			order := e.Value.(*Order)
+			if order.Price != level.price {
+				m.violation(Violation{Check: "level price", Pair: p.Name(), Order: order.Id,
+					Expected: level.price, Actual: order.Price})
+			}
+			if order.Seq <= seq {
+				m.violation(Violation{Check: "time priority", Pair: p.Name(), Order: order.Id,
+					Expected: seq + 1, Actual: order.Seq})
+			}
+			seq = order.Seq
+		}
+		if amount1, amount2 := level.sum(nil); amount1 != level.amount1 || amount2 != level.amount2 {
+			m.violation(Violation{Check: "level totals", Pair: p.Name(),
+				Expected: amount1 + amount2, Actual: level.amount1 + level.amount2})
+		}
+		count += level.orders.Len()
+		previous = level
+		return true
+	})
+	if count != b.len() {
+		m.violation(Violation{Check: "book length", Pair: p.Name(),
+			Expected: uint64(count), Actual: uint64(b.len())})
+	}
+}
+
+// checkConservation verifies per currency that everything ever supplied by
+// orders is still in their supply, was received by a counterparty or refunded,
+// or is accounted as a remainder kept by the house or a fee.
+func (m *Market) checkConservation() {
+	supplied := make(map[string]uint64)
+	held := make(map[string]uint64)
+	for _, order := range m.orderMap {
+		supplied[order.Supply.Currency] += order.supplied
+		held[order.Supply.Currency] += order.Supply.Amount
+		held[order.Supply.Currency] += order.Refunded
+		held[order.Received.Currency] += order.Received.Amount
+	}
+	for currency, amount := range m.remainders {
+		held[currency] += amount
+	}
+	for currency, amount := range m.fees {
+		held[currency] += amount
+	}
+	for _, currency := range m.Currencies() {
+		name := currency.Name
+		if supplied[name] != held[name] {
+			m.violation(Violation{Check: "conservation", Currency: name,
+				Expected: supplied[name], Actual: held[name]})
+		}
+	}
+}
+
+func (m *Market) checkInvariants() {
+	if m.invariants == InvariantOff {
+		return
+	}
+	names := make([]string, 0, len(m.pairMap))
+	for name := range m.pairMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m.checkBook(m.pairMap[name])
+	}
+	m.checkConservation()
+	m.checkLedger()
+
+	if len(m.violations) == 0 {
+		return
+	}
+	violations := m.violations
+	m.violations = nil
+	if m.invariants == InvariantPanic {
+		panic(fmt.Sprintf("reactor: broken invariant %v", violations))
+	}
+	m.lastEventId++
+	event := Event{
+		Id:         m.lastEventId,
+		Time:       m.now(),
+		EventType:  Error,
+		Error:      newError(ErrInvariant, "%d invariants broken", len(violations)),
+		Violations: violations,
+	}
+	m.lastEvents = append(m.lastEvents, event)
+}
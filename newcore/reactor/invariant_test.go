@@ -0,0 +1,61 @@
+package reactor
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestInvariantsHold trades random orders with the checks in panic mode.
+func TestInvariantsHold(t *testing.T) {
+	m := CreateMarket()
+	m.SetInvariantMode(InvariantPanic)
+	m.AddCurrency("BTC", 8)
+	m.AddCurrency("USD", 2)
+	m.AddPair("BTC", "USD")
+	r := rand.New(rand.NewSource(1))
+
+	for id := uint64(1); id <= 1000; id++ {
+		if r.Intn(5) == 0 {
+			m.CancelOrder(uint64(r.Int63n(int64(id))) + 1)
+			continue
+		}
+		isGreen := r.Intn(2) == 0
+		amount1 := uint64(r.Int63n(1e8) + 1)
+		amount2 := uint64(r.Int63n(1e6) + 1)
+		if r.Intn(10) == 0 {
+			if isGreen {
+				amount1 = 0
+			} else {
+				amount2 = 0
+			}
+		}
+		m.AddNewOrder(id, "", "BTC/USD", isGreen, amount1, amount2)
+	}
+}
+
+func TestInvariantReport(t *testing.T) {
+	m := CreateMarket()
+	m.SetInvariantMode(InvariantReport)
+	m.AddCurrency("AAA", 0)
+	m.AddCurrency("BBB", 0)
+	pair, _ := m.AddPair("AAA", "BBB")
+	m.AddNewOrder(1, "", "AAA/BBB", false, 10, 100)
+	pair.curr1volume++
+
+	events, _ := m.AddNewOrder(1, "", "AAA/BBB", false, 10, 100)
+	last := events[len(events)-1]
+	if last.EventType != Error || len(last.Violations) != 1 || last.Violations[0].Check != "book volume" {
+		t.Fatalf("broken book volume reported as %+v", last)
+	}
+	if v := last.Violations[0]; v.Expected != 10 || v.Actual != 11 || v.Currency != "AAA" {
+		t.Fatalf("violation is %v", v)
+	}
+
+	m.SetInvariantMode(InvariantPanic)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("broken invariant did not panic")
+		}
+	}()
+	m.AddNewOrder(1, "", "AAA/BBB", false, 10, 100)
+}
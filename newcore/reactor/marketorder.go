@@ -0,0 +1,72 @@
+package reactor
+
+// WithProtectionPrice keeps the part of a market order the book cannot fill
+// on the book as a limit order at price, a pair price as in Order.Price.
+// Without it, whatever is left of a market order is cancelled.
+func WithProtectionPrice(price uint64) OrderOption {
+	return func(o *Order) *MarketError {
+		if !o.IsMarketPrice {
+			return newError(ErrInvalidAmount, "only market orders take a protection price")
+		}
+		if price == 0 {
+			return newError(ErrInvalidAmount, "protection price must be positive")
+		}
+		o.ProtectionPrice = price
+		return nil
+	}
+}
+
+// WithProtectionPriceString is WithProtectionPrice for a price given as the
+// decimal amount of currency2 for one currency1, such as "65000.01".
+func WithProtectionPriceString(price string) OrderOption {
+	return func(o *Order) *MarketError {
+		amount2, err := o.pair.currency2.Parse(price)
+		if err != nil {
+			return err
+		}
+		rounding := RoundUp
+		if o.IsGreen {
+			rounding = RoundDown
+		}
+		scaled, ok := o.pair.calcPrice(o.pair.currency1.fraction, amount2, rounding)
+		if !ok {
+			return newError(ErrInvalidAmount, "protection price %s is out of range", price)
+		}
+		return WithProtectionPrice(scaled)(o)
+	}
+}
+
+// convert turns what is left of a market order into a limit order at its
+// protection price and puts it on the book, reported by a Convert event. It
+// is cancelled instead when its supply is too small to want anything at that
+// price.
+func (o *Order) convert() {
+	m := o.market
+	var want uint64
+	var ok bool
+	if o.IsGreen {
+		want, ok = o.pair.toCurrency1(o.Supply.Amount, o.ProtectionPrice, RoundDown)
+	} else {
+		want, ok = o.pair.toCurrency2(o.Supply.Amount, o.ProtectionPrice, RoundUp)
+	}
+	if !ok || want == 0 {
+		m.cancel(o, CancelUnfilled)
+		return
+	}
+	o.IsMarketPrice = false
+	o.Price = o.ProtectionPrice
+	o.Want.Amount = want
+
+	unfilled := o.Supply
+	m.lastEventId++
+	event := Event{
+		Id:        m.lastEventId,
+		Time:      m.now(),
+		EventType: Convert,
+		Order:     o,
+		Unfilled:  &unfilled,
+	}
+	m.lastEvents = append(m.lastEvents, event)
+	o.addToStack()
+	o.pair.swap(nil)
+}
@@ -0,0 +1,71 @@
+package reactor
+
+import "testing"
+
+func TestMarketOrder(t *testing.T) {
+	m, _ := newTestMarket(t)
+	tr := newTranscript(t)
+
+	events, _ := tr.step("market buy for 50 on an empty book").record(m.AddNewOrder(1, "b", testPair, true, 0, 50))
+	if cancel := findEvent(t, events, Cancel); cancel.Reason != CancelUnfilled || cancel.Unfilled.Amount != 50 {
+		t.Fatalf("market order on an empty book ends with %+v, want a cancel of 50 unfilled", cancel)
+	}
+
+	tr.step("sell 5 for 50").record(m.AddNewOrder(2, "a", testPair, false, 5, 50))
+	tr.step("sell 5 for 60").record(m.AddNewOrder(3, "a", testPair, false, 5, 60))
+	events, _ = tr.step("market buy for 80").record(m.AddNewOrder(4, "b", testPair, true, 0, 80))
+	if n := countEvents(events, SwapOrder); n != 2 {
+		t.Fatalf("market order swapped %d times, want 2", n)
+	}
+	if order := m.orderMap[4]; !order.IsClose || order.Received.Amount != 7 || order.Supply.Amount != 0 {
+		t.Fatalf("market order ends as %+v, want 7 received for all of its supply", order)
+	}
+	for _, e := range events {
+		if e.EventType == BookDelta && e.Delta.Side == Bid {
+			t.Fatalf("market order touched the bids: %+v", e.Delta)
+		}
+	}
+
+	events, _ = tr.step("market buy for 5, less than one unit at 12").record(m.AddNewOrder(5, "b", testPair, true, 0, 5))
+	if n := countEvents(events, SwapOrder); n != 0 {
+		t.Fatalf("market order worth less than one unit swapped %d times, want none", n)
+	}
+	if cancel := findEvent(t, events, Cancel); cancel.Reason != CancelUnfilled || cancel.Unfilled.Amount != 5 {
+		t.Fatalf("market order worth less than one unit ends with %+v, want a cancel of 5 unfilled", cancel)
+	}
+
+	events, _ = tr.step("market sell 3 with no bids").record(m.AddNewOrder(6, "a", testPair, false, 3, 0))
+	if cancel := findEvent(t, events, Cancel); cancel.Reason != CancelUnfilled || cancel.Unfilled.Amount != 3 {
+		t.Fatalf("market sell without bids ends with %+v, want a cancel of 3 unfilled", cancel)
+	}
+	tr.check("marketorder")
+}
+
+func TestMarketOrderProtection(t *testing.T) {
+	m, _ := newTestMarket(t)
+	tr := newTranscript(t)
+
+	_, err := tr.step("limit buy with a protection price").record(m.AddNewOrder(1, "b", testPair, true, 5, 50, WithProtectionPrice(10)))
+	if err == nil {
+		t.Fatal("limit order with a protection price accepted")
+	}
+
+	tr.step("sell 5 for 50").record(m.AddNewOrder(2, "a", testPair, false, 5, 50))
+	events, _ := tr.step("market buy for 100 protected at 9").record(m.AddNewOrder(3, "b", testPair, true, 0, 100, WithProtectionPriceString("9")))
+	convert := findEvent(t, events, Convert)
+	if convert.Unfilled.Amount != 50 || convert.Order.Price != 9 || convert.Order.Want.Amount != 5 {
+		t.Fatalf("protected market order converted as %+v, want 50 at 9 for 5", convert.Order)
+	}
+	if depth, _ := m.Depth(testPair, 0); len(depth.Bids) != 1 || depth.Bids[0].Price != 9 || len(depth.Asks) != 0 {
+		t.Fatalf("book after the conversion is %+v, want the remainder bid at 9", depth)
+	}
+
+	events, _ = tr.step("market sell 3 protected at 100").record(m.AddNewOrder(4, "a", testPair, false, 3, 0, WithProtectionPrice(100)))
+	if n := countEvents(events, SwapOrder); n != 1 {
+		t.Fatalf("protected market sell swapped %d times, want 1", n)
+	}
+	if order := m.orderMap[4]; !order.IsClose || order.Received.Amount != 27 {
+		t.Fatalf("protected market sell ends as %+v, want it filled for 27", order)
+	}
+	tr.check("protection")
+}
@@ -0,0 +1,103 @@
+package reactor
+
+// crossed tells whether the green and the red order of the swap trade. Two
+// market orders have no price to trade at, so they never do, and a market
+// order whose supply is worth nothing at the price of the other order has
+// nothing left to trade. Prices are rounded against their orders, so two
+// limit orders placed with the same terms have a green price one below the
+// red one: their limits are compared exactly instead.
+func (s *Swap) crossed() bool {
+	green, red := s.Green, s.Red
+	switch {
+	case green.IsMarketPrice && red.IsMarketPrice:
+		return false
+	case green.IsMarketPrice:
+		return green.Supply.Amount >= red.Want.Amount || red.give(green.Supply.Amount) > 0
+	case red.IsMarketPrice:
+		return red.Supply.Amount >= green.Want.Amount || green.give(red.Supply.Amount) > 0
+	case green.wanted != 0 && red.wanted != 0:
+		return !productLess(green.supplied, red.supplied, green.wanted, red.wanted)
+	}
+	return green.Price >= red.Price
+}
+
+// match fills the best green and the best red order as far as they go. The
+// executable amount of currency1 is the smaller of what the red order
+// supplies and what the green order wants, and the order that runs out of it
+// is filled completely. Every limit order trades at its own price: Money1 and
+// Money2 are exchanged at the price of one of them, Price, and whatever the
+// other one gives on top of that leaves its supply as a remainder. A market
+// order trades at the price of the limit order it meets, up to its supply.
+func (s *Swap) match() {
+	green, red := s.Green, s.Red
+	switch {
+	case red.IsMarketPrice:
+		// The red order sells as much as the green order buys at its price.
+		s.Price = green.Price
+		s.Money1 = green.Want.Amount
+		s.Money2 = green.Supply.Amount
+		if red.Supply.Amount < green.Want.Amount {
+			s.Money1 = red.Supply.Amount
+			s.Money2 = green.give(s.Money1)
+		}
+	case green.IsMarketPrice:
+		// The green order buys as much as its supply pays for at the red price.
+		s.Price = red.Price
+		s.Money1 = red.Supply.Amount
+		s.Money2 = red.Want.Amount
+		if green.Supply.Amount < red.Want.Amount {
+			s.Money2 = green.Supply.Amount
+			s.Money1 = red.give(s.Money2)
+		}
+	case red.Supply.Amount <= green.Want.Amount:
+		// The red order is filled, the green one pays for it at its own price.
+		s.Price = red.Price
+		s.Money1 = red.Supply.Amount
+		s.Money2 = red.Want.Amount
+		paid := green.Supply.Amount
+		if s.Money1 < green.Want.Amount {
+			paid = green.give(s.Money1)
+		}
+		if paid < s.Money2 {
+			// The rounded green price is below the red one, the limits
+			// are not: the green order pays what the red one wants.
+			paid = s.Money2
+		}
+		s.Remainder2 = paid - s.Money2
+	case green.Supply.Amount < red.Want.Amount:
+		// The green order is filled and all of its supply goes to the red
+		// one, which gives for it at its own price.
+		s.Price = green.Price
+		s.Money1 = green.Want.Amount
+		s.Money2 = green.Supply.Amount
+		given := red.give(s.Money2)
+		if given < s.Money1 {
+			// As above, the red order gives what the green one wants.
+			given = s.Money1
+		}
+		s.Remainder1 = given - s.Money1
+	default:
+		// The green order is filled, but its supply is more than the red
+		// order wants: the red order is paid for what it sells at its price.
+		s.Price = red.Price
+		s.Money1 = green.Want.Amount
+		s.Money2 = red.receive(s.Money1, green.Supply.Amount)
+		s.Remainder2 = green.Supply.Amount - s.Money2
+	}
+	red.fill(s.Money1+s.Remainder1, s.Money2)
+	green.fill(s.Money2+s.Remainder2, s.Money1)
+}
+
+// fill takes paid out of the supply of the order and adds got to what it
+// received. The want of a market order has no limit and is left as it is.
+func (o *Order) fill(paid uint64, got uint64) {
+	if o.level != nil {
+		o.level.uncount(o)
+		defer o.level.count(o)
+	}
+	o.Supply.Amount -= paid
+	o.Received.Amount += got
+	if !o.IsMarketPrice {
+		o.Want.Amount -= got
+	}
+}
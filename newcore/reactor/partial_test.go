@@ -0,0 +1,35 @@
+package reactor
+
+import "testing"
+
+func TestPartialFill(t *testing.T) {
+	m, _ := newTestMarket(t)
+	tr := newTranscript(t)
+
+	tr.step("a sells 30 for 300").record(m.AddNewOrder(1, "a", testPair, false, 30, 300))
+	events, _ := tr.step("b buys 10 for 100").record(m.AddNewOrder(2, "b", testPair, true, 10, 100))
+	fill := findEvent(t, events, PartialFill).Order
+	if fill.Id != 1 || fill.IsClose || fill.Supply.Amount != 20 || fill.Received.Amount != 100 {
+		t.Fatalf("partial fill of the ask is %+v, want 20 left and 100 received", fill)
+	}
+	if n := countEvents(events, PartialFill); n != 1 {
+		t.Fatalf("%d partial fills for one resting order", n)
+	}
+
+	// The bid takes the 20 left and rests with the rest of its supply.
+	events, _ = tr.step("c buys 50 for 500").record(m.AddNewOrder(3, "c", testPair, true, 50, 500))
+	fill = findEvent(t, events, PartialFill).Order
+	if fill.Id != 3 || fill.IsClose || fill.Supply.Amount != 300 || fill.Received.Amount != 20 {
+		t.Fatalf("partial fill of the bid is %+v, want 300 left and 20 received", fill)
+	}
+	depth, _ := m.Depth(testPair, 0)
+	if len(depth.Asks) != 0 || len(depth.Bids) != 1 || depth.Bids[0].Amount1 != 30 || depth.Bids[0].Amount2 != 300 {
+		t.Fatalf("book after the fills is %+v, want the rest of order 3 alone", depth)
+	}
+
+	events, _ = tr.step("d sells 30 for 300").record(m.AddNewOrder(4, "d", testPair, false, 30, 300))
+	if n := countEvents(events, PartialFill); n != 0 {
+		t.Fatalf("%d partial fills for orders that are filled", n)
+	}
+	tr.check("partial")
+}
@@ -1,27 +1,64 @@
 package reactor
 
 import (
-	"fmt"
+	"container/heap"
+	"container/list"
 	"math"
-	"time"
+	"math/big"
+	"sort"
 )
 
+// MaxDecimal is the largest precision a currency may have. Amounts are
+// uint64, so a currency with 18 decimals holds at most about 18 whole units.
+const MaxDecimal = 18
+
+// MaxPairDecimal is the largest sum of the decimals of the two currencies of a
+// pair. Prices are uint64 scaled by both currency fractions, so the highest
+// price a pair can hold is math.MaxUint64 / 10^(decimal1+decimal2): about 1.8
+// million currency2 for one currency1 at 13 decimals, 1.8 billion for
+// BTC(8)/USD(2). A pair like ETH(16)/USD(2) could not even hold 18 USD for
+// one ETH and is refused.
+const MaxPairDecimal = 13
+
 type Market struct {
-	pairMap     map[string]*Pair
-	orderMap    map[uint64]*Order
-	lastEventId uint64
-	lastEvents  []Event
-	fraction    float64
+	currencyMap  map[string]*Currency
+	pairMap      map[string]*Pair
+	orderMap     map[uint64]*Order
+	lastEventId  uint64
+	lastSeq      uint64
+	lastEvents   []Event
+	remainders   map[string]uint64
+	improvement  ImprovementPolicy
+	fees         map[string]uint64
+	invariants   InvariantMode
+	clock        Clock
+	ledger       *ledger
+	touched      map[levelKey]bool
+	touchedOrder []levelKey
+	expiries     expiryQueue
+	violations   []Violation
+}
+
+type Currency struct {
+	Name     string `json:"name"`
+	Decimal  uint8  `json:"decimal"`
+	fraction uint64
 }
 
 type Pair struct {
-	currency1   string `json:"currency1"`
-	currency2   string `json:"currency2"`
-	buyStack    []*Order
-	sellStack   []*Order
+	market      *Market
+	currency1   *Currency `json:"currency1"`
+	currency2   *Currency `json:"currency2"`
+	unit        *big.Int
+	buyStack    *book
+	sellStack   *book
 	curr1volume uint64
 	curr2volume uint64
-	//lastPrice   uint64
+	seq         uint64
+	fees        *FeeSchedule
+	volumes     map[string]uint64
+	lastPrice   uint64
+	slippage    *SlippageBand
 }
 
 type Money struct {
@@ -29,32 +66,58 @@ type Money struct {
 	Amount   uint64 `json:"amount"`
 }
 
+// Order is matched with strict price-time priority: a better price always
+// goes first, and orders at the same price are filled in the order of Seq,
+// the number the market gave them when it accepted them.
 type Order struct {
 	Id            uint64 `json:"id"`
+	Seq           uint64 `json:"seq"`
+	Owner         string `json:"owner,omitempty"`
 	PairName      string `json:"pair"`
+	Time          int64  `json:"time"`
+	market        *Market
 	pair          *Pair
-	IsGreen       bool   `json:"isGreen"`
-	Price         uint64 `json:"price"`
-	IsMarketPrice bool   `json:"isMarketPrice"`
-	Want          Money  `json:"want"`
-	Supply        Money  `json:"supply"`
-	Received      Money  `json:"received"`
-	IsClose       bool   `json:"isClose"`
+	level         *priceLevel
+	elem          *list.Element
+	IsGreen       bool        `json:"isGreen"`
+	Price         uint64      `json:"price"`
+	IsMarketPrice bool        `json:"isMarketPrice"`
+	Want          Money       `json:"want"`
+	Supply        Money       `json:"supply"`
+	Received      Money       `json:"received"`
+	Refunded      uint64      `json:"refunded"`
+	IsClose       bool        `json:"isClose"`
+	TimeInForce   TimeInForce `json:"timeInForce"`
+	ExpireTime    int64       `json:"expireTime,omitempty"`
+	// ProtectionPrice is the price the unfilled part of a market order
+	// rests at as a limit order, see WithProtectionPrice.
+	ProtectionPrice uint64 `json:"protectionPrice,omitempty"`
+	banded          bool
+	bandPrice       uint64
+	slipped         bool
+	// supplied and wanted are the amounts the order was placed with, its
+	// exact limit. wanted is zero for market orders.
+	supplied uint64
+	wanted   uint64
 }
 
 type Swap struct {
-	pair       *Pair
-	Green      *Order `json:"green"`
-	Red        *Order `json:"red"`
-	Price      uint64 `json:"price"`
-	Money1     uint64 `json:"money1"`
-	Money2     uint64 `json:"money2"`
-	Remainder1 uint64 `json:"remainder1"`
-	Remainder2 uint64 `json:"remainder2"`
+	market       *Market
+	pair         *Pair
+	Green        *Order      `json:"green"`
+	Red          *Order      `json:"red"`
+	Price        uint64      `json:"price"`
+	Money1       uint64      `json:"money1"`
+	Money2       uint64      `json:"money2"`
+	Remainder1   uint64      `json:"remainder1"`
+	Remainder2   uint64      `json:"remainder2"`
+	Remainder1To Beneficiary `json:"remainder1To,omitempty"`
+	Remainder2To Beneficiary `json:"remainder2To,omitempty"`
+	Taker        uint64      `json:"taker"`
+	Fee1         uint64      `json:"fee1"`
+	Fee2         uint64      `json:"fee2"`
 }
 
-var market Market
-
 type EventData interface {
 }
 
@@ -65,657 +128,661 @@ const (
 	SwapOrder
 	Cancel
 	Error
+	BookDelta
+	Ledger
+	PartialFill
+	Convert
 )
 
 type Event struct {
-	Id        uint64    `json:"id"`
-	Time      int64     `json:"time"`
-	EventType EventType `json:"type"`
-	Order     *Order    `json:"order"`
-	Swap      *Swap     `json:"swap"`
+	Id         uint64       `json:"id"`
+	Time       int64        `json:"time"`
+	EventType  EventType    `json:"type"`
+	Order      *Order       `json:"order"`
+	Swap       *Swap        `json:"swap"`
+	Delta      *Delta       `json:"delta,omitempty"`
+	Transfer   *Transfer    `json:"transfer,omitempty"`
+	Reason     CancelReason `json:"reason,omitempty"`
+	Unfilled   *Money       `json:"unfilled,omitempty"`
+	Error      *MarketError `json:"error,omitempty"`
+	Violations []Violation  `json:"violations,omitempty"`
+}
+
+// Clone returns a copy of the event that no longer shares its orders with the
+// market, so it can be handed to another goroutine.
+func (e Event) Clone() Event {
+	if e.Order != nil {
+		e.Order = e.Order.detached()
+	}
+	if e.Swap != nil {
+		swap := *e.Swap
+		swap.Green, swap.Red = swap.Green.detached(), swap.Red.detached()
+		e.Swap = &swap
+	}
+	if e.Transfer != nil {
+		transfer := *e.Transfer
+		e.Transfer = &transfer
+	}
+	return e
+}
+
+// PairName returns the pair the event belongs to, or "" for events that are
+// not about a pair.
+func (e *Event) PairName() string {
+	if e.Order != nil {
+		return e.Order.PairName
+	}
+	if e.Swap != nil {
+		return e.Swap.Green.PairName
+	}
+	if e.Delta != nil {
+		return e.Delta.Pair
+	}
+	return ""
+}
+
+// Owners returns the owners of the orders the event is about.
+func (e *Event) Owners() []string {
+	var owners []string
+	if e.Order != nil && e.Order.Owner != "" {
+		owners = append(owners, e.Order.Owner)
+	}
+	if e.Swap != nil {
+		for _, order := range []*Order{e.Swap.Green, e.Swap.Red} {
+			if order.Owner != "" {
+				owners = append(owners, order.Owner)
+			}
+		}
+	}
+	if e.Transfer != nil {
+		owners = append(owners, e.Transfer.Account)
+	}
+	return owners
+}
+
+// Option configures a market in CreateMarket.
+type Option func(m *Market)
+
+// WithClock makes the market take the time from clock instead of the system
+// clock.
+func WithClock(clock Clock) Option {
+	return func(m *Market) {
+		m.clock = clock
+	}
 }
 
-func CreateMarket() *Market {
-	market = Market{
+// WithInvariantMode switches on the invariant checks from the start.
+func WithInvariantMode(mode InvariantMode) Option {
+	return func(m *Market) {
+		m.invariants = mode
+	}
+}
+
+func CreateMarket(options ...Option) *Market {
+	market := Market{
+		currencyMap: make(map[string]*Currency),
 		pairMap:     make(map[string]*Pair),
 		orderMap:    make(map[uint64]*Order),
 		lastEventId: 0,
 		lastEvents:  make([]Event, 0),
-		fraction:    10000,
+		remainders:  make(map[string]uint64),
+		fees:        make(map[string]uint64),
+		touched:     make(map[levelKey]bool),
+		clock:       systemClock{},
+		improvement: ImproveHouse,
+	}
+	for _, option := range options {
+		option(&market)
 	}
 	return &market
 }
 
-func (m *Market) AddPair(currency1 string, currency2 string) (*Pair, bool) {
+// SetClock replaces the clock of a market that already exists, such as one
+// loaded from a snapshot. Replaying commands with the clock they first ran
+// under gives the same events again.
+func (m *Market) SetClock(clock Clock) {
+	m.clock = clock
+}
+
+func (m *Market) now() int64 {
+	return m.clock.Now()
+}
+
+func (m *Market) AddCurrency(name string, decimal uint8) (*Currency, error) {
+	if _, exists := m.currencyMap[name]; exists {
+		return nil, newError(ErrDuplicateCurrency, "currency %s exists", name)
+	}
+	if name == "" || decimal > MaxDecimal {
+		return nil, newError(ErrInvalidCurrency, "currency %q with %d decimals not allowed", name, decimal)
+	}
+	currency := Currency{
+		Name:     name,
+		Decimal:  decimal,
+		fraction: pow10(decimal),
+	}
+	m.currencyMap[name] = &currency
+	return &currency, nil
+}
+
+func (m *Market) Currency(name string) (*Currency, bool) {
+	currency, exists := m.currencyMap[name]
+	return currency, exists
+}
+
+func (m *Market) Currencies() []*Currency {
+	list := make([]*Currency, 0, len(m.currencyMap))
+	for _, currency := range m.currencyMap {
+		list = append(list, currency)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func pow10(decimal uint8) uint64 {
+	var fraction uint64 = 1
+	for i := uint8(0); i < decimal; i++ {
+		fraction *= 10
+	}
+	return fraction
+}
+
+func (m *Market) AddPair(currency1 string, currency2 string) (*Pair, error) {
 	pairName := currency1 + "/" + currency2
+	cur1, ok1 := m.currencyMap[currency1]
+	cur2, ok2 := m.currencyMap[currency2]
 	_, exists := m.pairMap[pairName]
-	if !exists {
-		m.pairMap[pairName] = preparePair(currency1, currency2)
-		//m.pairMap[pairName] = preparePair(currency1, currency2, uint64(math.Round(lastPrice*m.fraction*m.fraction)))
-		return m.pairMap[pairName], false
-	} else {
-		fmt.Printf("Pair %s exists\n", pairName)
-		return nil, true
+	if exists {
+		return nil, newError(ErrDuplicatePair, "pair %s exists", pairName)
+	}
+	if !ok1 {
+		return nil, newError(ErrUnknownCurrency, "currency %s not found", currency1)
+	}
+	if !ok2 {
+		return nil, newError(ErrUnknownCurrency, "currency %s not found", currency2)
+	}
+	if cur1 == cur2 {
+		return nil, newError(ErrInvalidPair, "pair %s not allowed", pairName)
 	}
+	if cur1.Decimal+cur2.Decimal > MaxPairDecimal {
+		return nil, newError(ErrInvalidPair, "pair %s has more than %d decimals", pairName, MaxPairDecimal)
+	}
+	m.pairMap[pairName] = m.preparePair(cur1, cur2)
+	return m.pairMap[pairName], nil
+}
+
+func (p *Pair) Name() string {
+	return p.currency1.Name + "/" + p.currency2.Name
 }
 
 func (m *Market) newOrderEvent(order *Order) {
 	m.lastEventId++
 	event := Event{
 		Id:        m.lastEventId,
-		Time:      time.Now().UnixNano(),
+		Time:      m.now(),
 		EventType: Create,
 		Order:     order,
 	}
 	m.lastEvents = append(m.lastEvents, event)
 }
 
-func preparePair(currency1 string, currency2 string) *Pair {
+// partialFillEvent reports an order that traded in a swap and stays on the
+// book with what is left of it.
+func (m *Market) partialFillEvent(order *Order) {
+	m.lastEventId++
+	event := Event{
+		Id:        m.lastEventId,
+		Time:      m.now(),
+		EventType: PartialFill,
+		Order:     order,
+	}
+	m.lastEvents = append(m.lastEvents, event)
+}
+
+func (m *Market) preparePair(currency1 *Currency, currency2 *Currency) *Pair {
 	pair := Pair{
+		market:      m,
 		currency1:   currency1,
 		currency2:   currency2,
-		buyStack:    make([]*Order, 0),
-		sellStack:   make([]*Order, 0),
+		unit:        new(big.Int).Mul(new(big.Int).SetUint64(currency1.fraction), new(big.Int).SetUint64(currency1.fraction)),
+		buyStack:    newBuyBook(),
+		sellStack:   newSellBook(),
 		curr1volume: 0,
 		curr2volume: 0,
-		//lastPrice:   lastPrice,
+		volumes:     make(map[string]uint64),
 	}
 
 	return &pair
 }
 
-func (m *Market) AddNewOrder(id uint64, pairName string, isGreen bool, currency1 float64, currency2 float64) []Event {
+// AddNewOrder takes both amounts already scaled by the precision of their
+// currencies. A zero amount on the want side makes a market order. A refused
+// order is reported both as the returned error and as an Error event. The
+// options set the time in force of the order, GoodTillCancel by default.
+func (m *Market) AddNewOrder(id uint64, owner string, pairName string, isGreen bool, amount1 uint64, amount2 uint64, options ...OrderOption) ([]Event, error) {
 	m.lastEvents = m.lastEvents[:0]
-	order, err := prepareOrder(id, pairName, isGreen, currency1, currency2)
-	if !err {
-		market.orderMap[id] = order
-
-		order.addToStack()
-	} else {
-		m.lastEventId++
-		event := Event{
-			Id:        m.lastEventId,
-			Time:      time.Now().UnixNano(),
-			EventType: Error,
-			Order:     order,
+	m.expire()
+	order, err := m.prepareOrder(id, owner, pairName, isGreen, amount1, amount2, options)
+	if err == nil {
+		order.setBand()
+	}
+	if err == nil && order.TimeInForce == FillOrKill && !order.fillable() {
+		err = newError(ErrNotFillable, "order %d cannot be filled by the book", id)
+	}
+	if err == nil {
+		err = m.reserve(order)
+	}
+	if err != nil {
+		m.errorEvent(nil, err)
+		m.flushDeltas()
+		m.checkInvariants()
+		return m.lastEvents, err
+	}
+	m.lastSeq++
+	order.Seq = m.lastSeq
+	m.orderMap[id] = order
+
+	order.place()
+	if !order.IsClose {
+		switch {
+		case order.slipped:
+			m.cancel(order, CancelSlippage)
+		case order.TimeInForce == ImmediateOrCancel || order.TimeInForce == FillOrKill:
+			m.cancel(order, CancelUnfilled)
+		case order.IsMarketPrice && order.ProtectionPrice != 0:
+			order.convert()
+		case order.IsMarketPrice:
+			m.cancel(order, CancelUnfilled)
+		default:
+			order.addToStack()
 		}
-		m.lastEvents = append(m.lastEvents, event)
 	}
-	return m.lastEvents
+	if !order.IsClose && order.TimeInForce == GoodTillDate {
+		heap.Push(&m.expiries, order)
+	}
+	m.flushDeltas()
+	m.checkInvariants()
+	return m.lastEvents, nil
+}
+
+// AddNewOrderString is AddNewOrder for amounts given as decimal strings.
+func (m *Market) AddNewOrderString(id uint64, owner string, pairName string, isGreen bool, currency1 string, currency2 string, options ...OrderOption) ([]Event, error) {
+	var amount1, amount2 uint64
+	var err *MarketError
+	if pair, exists := m.pairMap[pairName]; exists {
+		amount1, err = pair.currency1.Parse(currency1)
+		if err == nil {
+			amount2, err = pair.currency2.Parse(currency2)
+		}
+	}
+	if err != nil {
+		m.lastEvents = m.lastEvents[:0]
+		m.errorEvent(nil, err)
+		return m.lastEvents, err
+	}
+	return m.AddNewOrder(id, owner, pairName, isGreen, amount1, amount2, options...)
 }
 
-func (m *Market) CancelOrder(id uint64) []Event {
-	m.lastEvents = m.lastEvents[:0]
-	order, exists := m.orderMap[id]
+func (m *Market) errorEvent(order *Order, err *MarketError) {
 	m.lastEventId++
 	event := Event{
-		Id:   m.lastEventId,
-		Time: time.Now().UnixNano(),
+		Id:        m.lastEventId,
+		Time:      m.now(),
+		EventType: Error,
+		Order:     order,
+		Error:     err,
 	}
-	if exists {
-		order.close()
-		event.EventType = Cancel
-		event.Order = order
+	m.lastEvents = append(m.lastEvents, event)
+}
+
+// CancelOrder takes a resting order off the book. Orders that were already
+// filled, cancelled or expired are refused with ErrOrderClosed and the Error
+// event carries their final state.
+func (m *Market) CancelOrder(id uint64) ([]Event, error) {
+	m.lastEvents = m.lastEvents[:0]
+	m.expire()
+	order, exists := m.orderMap[id]
+	var err *MarketError
+	if !exists {
+		err = newError(ErrUnknownOrder, "order %d not found", id)
+		m.errorEvent(nil, err)
+	} else if order.IsClose {
+		err = newError(ErrOrderClosed, "order %d is closed", id)
+		m.errorEvent(order, err)
 	} else {
-		event.EventType = Error
+		m.cancel(order, "")
+	}
+	m.flushDeltas()
+	m.checkInvariants()
+	if err != nil {
+		return m.lastEvents, err
+	}
+	return m.lastEvents, nil
+}
+
+// CancelOwnOrder is CancelOrder for an order of owner. The order of another
+// owner is refused as unknown, so that its existence is not revealed.
+func (m *Market) CancelOwnOrder(id uint64, owner string) ([]Event, error) {
+	if order, exists := m.orderMap[id]; exists && order.Owner != owner {
+		m.lastEvents = m.lastEvents[:0]
+		err := newError(ErrUnknownOrder, "order %d not found", id)
+		m.errorEvent(nil, err)
+		return m.lastEvents, err
+	}
+	return m.CancelOrder(id)
+}
+
+// cancel closes the order and reports it with a Cancel event. Unfilled is
+// the supply the order gets back.
+func (m *Market) cancel(order *Order, reason CancelReason) {
+	order.close()
+	unfilled := order.Supply
+	m.lastEventId++
+	event := Event{
+		Id:        m.lastEventId,
+		Time:      m.now(),
+		EventType: Cancel,
+		Order:     order,
+		Reason:    reason,
+		Unfilled:  &unfilled,
 	}
 	m.lastEvents = append(m.lastEvents, event)
-	return m.lastEvents
 }
 
-func prepareOrder(id uint64, pairName string, isGreen bool, currency1 float64, currency2 float64) (*Order, bool) {
+func (m *Market) prepareOrder(id uint64, owner string, pairName string, isGreen bool, amount1 uint64, amount2 uint64, options []OrderOption) (*Order, *MarketError) {
 
-	_, exists := market.orderMap[id]
+	_, exists := m.orderMap[id]
 	if exists {
-		fmt.Printf("Order with id %d exists \n", id)
-		return nil, true
+		return nil, newError(ErrDuplicateOrder, "order with id %d exists", id)
+	}
+
+	if owner == HouseAccount {
+		return nil, newError(ErrInvalidAccount, "owner %q is reserved", owner)
 	}
 
-	pair, exists := market.pairMap[pairName]
+	pair, exists := m.pairMap[pairName]
 	if !exists {
-		fmt.Printf("Pair %s not found \n", pairName)
-		return nil, true
+		return nil, newError(ErrUnknownPair, "pair %s not found", pairName)
 	}
 
-	price, isMarketPrice, err := calcPrice(isGreen, currency1, currency2)
-	if err {
-		fmt.Printf("Error calc price. \n isGreen: %x \t Currency 1: %d \t Currency 2: %d \n",
-			isGreen, currency1, currency2)
-		return nil, true
+	price, isMarketPrice, err := calcPrice(pair, isGreen, amount1, amount2)
+	if err != nil {
+		return nil, err
 	}
 
 	order := Order{
 		Id:            id,
+		Owner:         owner,
 		PairName:      pairName,
+		Time:          m.now(),
+		market:        m,
 		pair:          pair,
 		IsGreen:       isGreen,
 		Price:         price,
 		IsMarketPrice: isMarketPrice,
 		IsClose:       false,
+		supplied:      amount1,
+		wanted:        amount2,
+	}
+	if isGreen {
+		order.supplied, order.wanted = amount2, amount1
 	}
 
 	var wantAmount uint64
 
 	var supplyAmount uint64
 	if isGreen {
-		supplyAmount = uint64(math.Round(currency2 * market.fraction))
+		supplyAmount = amount2
 		if isMarketPrice {
 			wantAmount = math.MaxUint64
 		} else {
-			wantAmount = uint64(math.Round(currency1 * market.fraction))
+			wantAmount = amount1
 		}
 
 		order.Want = Money{
-			Currency: pair.currency1,
+			Currency: pair.currency1.Name,
 			Amount:   wantAmount,
 		}
 
 		order.Supply = Money{
-			Currency: pair.currency2,
+			Currency: pair.currency2.Name,
 			Amount:   supplyAmount,
 		}
 		order.Received = Money{
-			Currency: pair.currency1,
+			Currency: pair.currency1.Name,
 			Amount:   0,
 		}
 	} else {
-		supplyAmount = uint64(math.Round(currency1 * market.fraction))
+		supplyAmount = amount1
 		if isMarketPrice {
 			wantAmount = 0
 		} else {
-			wantAmount = uint64(math.Round(currency2 * market.fraction))
+			wantAmount = amount2
 		}
 		order.Want = Money{
-			Currency: pair.currency2,
+			Currency: pair.currency2.Name,
 			Amount:   wantAmount,
 		}
 
 		order.Supply = Money{
-			Currency: pair.currency1,
+			Currency: pair.currency1.Name,
 			Amount:   supplyAmount,
 		}
 		order.Received = Money{
-			Currency: pair.currency2,
+			Currency: pair.currency2.Name,
 			Amount:   0,
 		}
 	}
 
-	return &order, false
-}
-
-func calcPrice(isGreen bool, currency1 float64, currency2 float64) (price uint64, isMarketPrice bool, err bool) {
-	if currency1 != 0 && currency2 != 0 {
-		price = uint64(math.Round(currency2/currency1) * market.fraction * market.fraction)
-		return price, false, false
-	} else if currency1 == 0 && currency2 == 0 {
-		return 0, true, true
-	} else if currency1 == 0 && isGreen {
+	for _, option := range options {
+		if err := option(&order); err != nil {
+			return nil, err
+		}
+	}
+	if err := order.checkTimeInForce(); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// Price is kept as the amount of currency2 for one currency1, scaled by the
+// fractions of both currencies, see MaxPairDecimal. Green prices are
+// rounded down and red prices up, so neither side trades past its limit.
+func calcPrice(pair *Pair, isGreen bool, amount1 uint64, amount2 uint64) (price uint64, isMarketPrice bool, err *MarketError) {
+	if amount1 == 0 && amount2 == 0 {
+		return 0, false, newError(ErrInvalidAmount, "nothing to trade: currency 1 %d, currency 2 %d", amount1, amount2)
+	} else if amount1 != 0 && amount2 != 0 {
+		rounding := RoundUp
+		if isGreen {
+			rounding = RoundDown
+		}
+		price, ok := pair.calcPrice(amount1, amount2, rounding)
+		if !ok {
+			return 0, false, newError(ErrInvalidAmount, "price of %d for %d is out of range", amount2, amount1)
+		}
+		return price, false, nil
+	} else if amount1 == 0 && isGreen {
 		price = math.MaxUint64
-		return price, true, false
-	} else if currency2 == 0 && !isGreen {
+		return price, true, nil
+	} else if amount2 == 0 && !isGreen {
 		price = 0
-		return price, true, false
+		return price, true, nil
 	} else {
-		return 0, true, true
+		return 0, true, newError(ErrInvalidAmount, "nothing to trade: currency 1 %d, currency 2 %d", amount1, amount2)
 	}
 }
 
+// give returns how much of its supply the order pays for amount of the
+// currency it wants, at its own price. The result is rounded down and never
+// exceeds the remaining supply.
 func (o *Order) give(amount uint64) uint64 {
 	var give uint64 = 0
 	if !o.IsMarketPrice {
+		var ok bool
 		if o.IsGreen {
-			give = uint64(math.Round((float64(amount) * (float64(o.Price) / market.fraction)) /
-				market.fraction))
+			give, ok = o.pair.toCurrency2(amount, o.Price, RoundDown)
 		} else {
-			give = uint64(math.Round(((float64(amount) * market.fraction) / float64(o.Price)) *
-				market.fraction))
+			give, ok = o.pair.toCurrency1(amount, o.Price, RoundDown)
+		}
+		if !ok || give > o.Supply.Amount {
+			give = o.Supply.Amount
 		}
 	}
 	return give
 }
 
-func (o *Order) addMoney(amount uint64, give uint64) {
-
-	if !o.IsMarketPrice {
-		if o.Supply.Amount >= give && o.Want.Amount >= amount {
-			o.Supply.Amount -= give
-			o.Want.Amount -= amount
-			o.Received.Amount += amount
-		} else {
-			give = 0
-			fmt.Printf("Not enough money.\n Supply: %d \t Give: %d \t Want: %d \t Amount: %d \n",
-				o.Supply.Amount, give, o.Want.Amount, amount)
-		}
+// receive returns what a red order gets for amount of its supply at its own
+// price. It is rounded up so the order never sells below its limit, but never
+// exceeds its remaining want nor max, what the counterparty has to pay.
+func (o *Order) receive(amount uint64, max uint64) uint64 {
+	receive, ok := o.pair.toCurrency2(amount, o.Price, RoundUp)
+	if !ok || receive > o.Want.Amount {
+		receive = o.Want.Amount
+	}
+	if receive > max {
+		receive = max
 	}
+	return receive
 }
 
-func (o *Order) takeMoney(amount uint64) {
+// filled tells whether the order has nothing left to trade: its supply is
+// gone or, for a limit order, it got everything it wanted. Only filled and
+// cancelled orders are closed, everything else stays on the book.
+func (o *Order) filled() bool {
+	return o.Supply.Amount == 0 || (!o.IsMarketPrice && o.Want.Amount == 0)
+}
 
+// place reports the new order and matches it against the book. The order
+// only takes what the other side offers, AddNewOrder decides what becomes of
+// the rest of it.
+func (o *Order) place() {
+	o.market.newOrderEvent(o)
+	o.pair.swap(o)
 }
 
 func (o *Order) addToStack() {
 	if o.IsGreen {
+		o.pair.buyStack.add(o)
 		o.pair.curr2volume += o.Supply.Amount
-		o.addToBuyStack()
 	} else {
+		o.pair.sellStack.add(o)
 		o.pair.curr1volume += o.Supply.Amount
-		o.addToSellStack()
 	}
-	market.newOrderEvent(o)
-	o.pair.swap()
+	o.touch()
+}
+
+// onBook tells whether the order rests on the book.
+func (o *Order) onBook() bool {
+	return o.level != nil
 }
 
+// detached returns a copy of the order that is not on the book, so filling
+// it leaves the totals of the price level alone.
+func (o *Order) detached() *Order {
+	order := *o
+	order.level, order.elem = nil, nil
+	return &order
+}
+
+// close takes the order off the book. Pair volumes only track the supply of
+// resting orders, so whatever is left of it leaves the volume as well.
 func (o *Order) close() {
+	if o.IsClose {
+		return
+	}
 	o.IsClose = true
+	o.market.release(o)
+	if !o.onBook() {
+		return
+	}
 	if o.IsGreen {
-		o.pair.curr1volume -= o.Received.Amount
 		o.pair.curr2volume -= o.Supply.Amount
-		o.removeFromBuyStack()
+		o.pair.buyStack.remove(o)
 	} else {
 		o.pair.curr1volume -= o.Supply.Amount
-		o.pair.curr2volume -= o.Received.Amount
-		o.removeFromSellStack()
+		o.pair.sellStack.remove(o)
 	}
-}
-
-func (o *Order) addToSellStack() {
-	stackLen := len(o.pair.sellStack)
-	last := stackLen - 1
-	if stackLen < 1 || o.Price >= o.pair.sellStack[last].Price {
-		o.pair.sellStack = append(o.pair.sellStack, o)
-	} else if o.Price < o.pair.sellStack[0].Price {
-		o.pair.sellStack = append(o.pair.sellStack, o.pair.sellStack[last])
-		copy(o.pair.sellStack[1:], o.pair.sellStack[:last])
-		o.pair.sellStack[0] = o
-	} else {
-		for i := 1; i < stackLen; i++ {
-			if o.Price >= o.pair.sellStack[i-1].Price && o.Price < o.pair.sellStack[i].Price {
-				o.pair.sellStack = append(o.pair.sellStack, o.pair.sellStack[last])
-				copy(o.pair.sellStack[i+1:], o.pair.sellStack[i:last])
-				o.pair.sellStack[i] = o
-				break
-			}
+	o.touch()
+}
+
+// swap matches the best orders of both sides until they no longer cross.
+// An incoming order that is not on the book takes the place of the best
+// order of its side until it is filled or the best order of the other side
+// is outside its slippage band.
+func (p *Pair) swap(incoming *Order) {
+	green, red := p.buyStack.best(), p.sellStack.best()
+	if incoming != nil {
+		if incoming.IsClose {
+			return
 		}
-	}
-	o.pair.curr1volume += o.Supply.Amount
-}
-
-func (o *Order) addToBuyStack() {
-	stackLen := len(o.pair.buyStack)
-	last := stackLen - 1
-	if stackLen < 1 || o.Price <= o.pair.buyStack[last].Price {
-		o.pair.buyStack = append(o.pair.buyStack, o)
-	} else if o.Price > o.pair.buyStack[0].Price {
-		o.pair.buyStack = append(o.pair.buyStack, o.pair.buyStack[last])
-		copy(o.pair.buyStack[1:], o.pair.buyStack[:last])
-		o.pair.buyStack[0] = o
-	} else {
-		for i := 1; i < stackLen; i++ {
-			if o.Price <= o.pair.buyStack[i-1].Price && o.Price > o.pair.buyStack[i].Price {
-				o.pair.buyStack = append(o.pair.buyStack, o.pair.buyStack[last])
-				copy(o.pair.buyStack[i+1:], o.pair.buyStack[i:last])
-				o.pair.buyStack[i] = o
-				break
-			}
+		if incoming.IsGreen {
+			green = incoming
+		} else {
+			red = incoming
 		}
 	}
-	o.pair.curr2volume += o.Supply.Amount
-}
-
-func (o *Order) removeFromSellStack() {
-	stackLen := len(o.pair.sellStack)
-	if stackLen < 2 {
-		o.pair.sellStack = o.pair.sellStack[:0]
-	} else {
-		for i, order := range o.pair.sellStack {
-			if order == o {
-				copy(o.pair.sellStack[i:], o.pair.sellStack[i+1:])
-				o.pair.sellStack = o.pair.sellStack[:stackLen-1]
-				break
-			}
-		}
+	if green == nil || red == nil {
+		return
 	}
-}
-
-func (o *Order) removeFromBuyStack() {
-	stackLen := len(o.pair.buyStack)
-	if stackLen < 2 {
-		o.pair.buyStack = o.pair.buyStack[:0]
-	} else {
-		for i, order := range o.pair.buyStack {
-			if order == o {
-				copy(o.pair.buyStack[i:], o.pair.buyStack[i+1:])
-				o.pair.buyStack = o.pair.buyStack[:stackLen-1]
-				break
-			}
+	if incoming != nil {
+		resting := red
+		if !incoming.IsGreen {
+			resting = green
+		}
+		if !incoming.withinBand(resting) {
+			incoming.slipped = true
+			return
 		}
 	}
-}
+	swap := Swap{
+		market: p.market,
+		pair:   p,
+		Green:  green,
+		Red:    red,
+	}
+	if swap.crossed() {
+		greenState, redState := green.state(), red.state()
+		greenOnBook, redOnBook := green.onBook(), red.onBook()
 
-func (p *Pair) swap() {
-	if len(p.buyStack) > 0 && len(p.sellStack) > 0 && p.buyStack[0].Price >= p.sellStack[0].Price {
+		swap.match()
 
-		swap := Swap{
-			pair:  p,
-			Green: p.buyStack[0],
-			Red:   p.sellStack[0],
-		}
-
-		if swap.Red.IsMarketPrice {
-			if swap.Red.Supply.Amount > swap.Green.Want.Amount {
-				swap.case5()
-			} else if swap.Red.Supply.Amount < swap.Green.Want.Amount {
-				swap.case8()
-			} else if swap.Red.Supply.Amount == swap.Green.Want.Amount {
-				swap.case9()
-			} else {
-				fmt.Println("Case not found!!")
-			}
-		} else if swap.Green.IsMarketPrice {
-			if swap.Green.Supply.Amount > swap.Red.Want.Amount {
-				swap.case2()
-			} else if swap.Green.Supply.Amount < swap.Red.Want.Amount {
-				swap.case7()
-			} else if swap.Green.Supply.Amount == swap.Red.Want.Amount {
-				swap.case10()
-			} else {
-				fmt.Println("Case not found!!")
-			}
-		} else if swap.Red.Supply.Amount > swap.Green.Want.Amount {
-			if swap.Green.Supply.Amount > swap.Red.Want.Amount {
-				swap.case1()
-			} else if swap.Green.Supply.Amount < swap.Red.Want.Amount {
-				swap.case6()
-			} else if swap.Green.Supply.Amount == swap.Red.Want.Amount {
-				swap.case11()
-			} else {
-				fmt.Println("Case not found!!")
-			}
-		} else if swap.Red.Supply == swap.Green.Want {
-			if swap.Green.Supply.Amount > swap.Red.Want.Amount {
-				swap.case4()
-			} else if swap.Green.Supply.Amount == swap.Red.Want.Amount {
-				swap.case12()
-			} else {
-				fmt.Println("Case not found!!")
+		for _, order := range []*Order{green, red} {
+			if order.filled() {
+				order.close()
 			}
-		} else if swap.Red.Supply.Amount < swap.Green.Want.Amount {
-			if swap.Green.Supply.Amount > swap.Red.Want.Amount {
-				swap.case3()
-			} else {
-				fmt.Println("Case not found!!")
-			}
-		} else {
-			fmt.Println("Case not found!!")
+		}
+		p.chargeFees(&swap)
+		if greenOnBook {
+			green.touch()
+			p.curr2volume -= swap.Money2 + swap.Remainder2
+		}
+		if redOnBook {
+			red.touch()
+			p.curr1volume -= swap.Money1 + swap.Remainder1
+		}
+		m := p.market
+		p.creditRemainders(&swap)
+		m.settle(&swap)
+		if m.invariants != InvariantOff {
+			m.checkSwap(&swap, greenState, redState)
 		}
 
-		market.lastEventId++
+		m.lastEventId++
 
 		event := Event{
-			Id:        market.lastEventId,
-			Time:      time.Now().UnixNano(),
+			Id:        m.lastEventId,
+			Time:      m.now(),
 			EventType: SwapOrder,
 			Swap:      &swap,
 		}
 
-		market.lastEvents = append(market.lastEvents, event)
-		//p.lastPrice = swap.Price
-
-		fmt.Printf("Swap: %+v \n", swap)
+		m.lastEvents = append(m.lastEvents, event)
+		for _, order := range []*Order{green, red} {
+			if !order.IsClose {
+				m.partialFillEvent(order)
+			}
+		}
+		p.lastPrice = swap.Price
 
-		p.swap()
+		p.swap(incoming)
 	}
 }
-
-func (s *Swap) case1() {
-	fmt.Println("Red.Supply > Green.Want")
-	fmt.Println("Green.Supply > Red.Want")
-
-	s.Money1 = s.Green.Want.Amount
-	s.Money2 = s.Red.Want.Amount
-	s.Price = uint64(math.Round(float64(s.Money2)/float64(s.Money1)) * market.fraction * market.fraction)
-
-	s.Remainder1 = s.Red.Supply.Amount - s.Green.Want.Amount
-	s.Remainder2 = s.Green.Supply.Amount - s.Red.Want.Amount
-
-	s.Red.Supply.Amount = 0
-	s.Red.Received.Amount += s.Money2
-	s.Red.Want.Amount = 0
-
-	s.Green.Supply.Amount = 0
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount = 0
-
-	s.Red.close()
-	s.Green.close()
-	s.pair.curr1volume -= s.Remainder1
-	s.pair.curr2volume -= s.Remainder2
-
-}
-
-func (s *Swap) case2() {
-	fmt.Println("Green.Supply > Red.Want")
-	fmt.Println("Green.IsMarketPrice")
-
-	s.Price = s.Red.Price
-	s.Money1 = s.Red.Supply.Amount
-	s.Money2 = s.Red.Want.Amount
-
-	s.Red.Supply.Amount -= s.Money1
-	s.Green.Received.Amount += s.Money1
-
-	s.Green.Supply.Amount -= s.Money2
-	s.Red.Want.Amount -= s.Money2
-	s.Red.Received.Amount += s.Money2
-
-	s.Red.close()
-
-}
-
-func (s *Swap) case3() {
-	fmt.Println("Green.Supply > Red.Want")
-	fmt.Println("Red.Supply < Green.Want")
-
-	s.Price = s.Red.Price
-	s.Money1 = s.Red.Supply.Amount
-	s.Money2 = s.Red.Want.Amount
-
-	s.Remainder2 = s.Green.give(s.Money2) - s.Red.Want.Amount
-
-	s.Red.Supply.Amount = 0
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount -= s.Money1
-
-	s.Green.Supply.Amount -= (s.Money2 + s.Remainder2)
-	s.Red.Want.Amount = 0
-	s.Red.Received.Amount += s.Money2
-
-	s.Red.close()
-	s.pair.curr2volume -= s.Remainder2
-
-}
-
-func (s *Swap) case4() {
-	fmt.Println("Green.Supply > Red.Want")
-	fmt.Println("Red.Supply = Green.Want")
-
-	s.Price = s.Red.Price
-	s.Money1 = s.Red.Supply.Amount
-	s.Money2 = s.Red.Want.Amount
-
-	s.Remainder2 = s.Green.Supply.Amount - s.Red.Want.Amount
-
-	s.Red.Supply.Amount = 0
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount = 0
-
-	s.Green.Supply.Amount = 0
-	s.Red.Want.Amount = 0
-	s.Red.Received.Amount += s.Money2
-
-	s.Red.close()
-	s.Green.close()
-	s.pair.curr2volume -= s.Remainder2
-}
-
-func (s *Swap) case5() {
-	fmt.Println("Red.Supply > Green.Want")
-	fmt.Println("Red.IsMarketPrice")
-
-	s.Price = s.Green.Price
-	s.Money1 = s.Green.Want.Amount
-	s.Money2 = s.Green.Supply.Amount
-
-	s.Red.Supply.Amount -= s.Money1
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount = 0
-
-	s.Red.Received.Amount += s.Money2
-	s.Green.Supply.Amount = 0
-
-	s.Green.close()
-}
-
-func (s *Swap) case6() {
-	fmt.Println("Green.Supply < Red.Want")
-	fmt.Println("Red.Supply > Green.Want")
-
-	s.Price = s.Green.Price
-	s.Money1 = s.Green.Want.Amount
-	s.Money2 = s.Green.Supply.Amount
-
-	s.Remainder1 = s.Red.give(s.Money2) - s.Green.Want.Amount
-
-	s.Green.Supply.Amount = 0
-	s.Red.Received.Amount += s.Money2
-	s.Red.Want.Amount -= s.Money2
-
-	s.Red.Supply.Amount -= (s.Money1 + s.Remainder1)
-	s.Green.Want.Amount = 0
-	s.Green.Received.Amount += s.Money1
-
-	s.Green.close()
-	s.pair.curr1volume -= s.Remainder1
-}
-
-func (s *Swap) case7() {
-	fmt.Println("Green.Supply < Red.Want")
-	fmt.Println("Green.IsMarketPrice")
-
-	s.Price = s.Red.Price
-	s.Money2 = s.Green.Supply.Amount
-	s.Money1 = s.Red.give(s.Money2)
-
-	s.Red.Supply.Amount -= s.Money1
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount = 0
-
-	s.Green.Supply.Amount = 0
-	s.Red.Want.Amount -= s.Money2
-	s.Red.Received.Amount += s.Money2
-
-	s.Green.close()
-
-}
-
-func (s *Swap) case8() {
-	fmt.Println("Red.Supply < Green.Want")
-	fmt.Println("Red.IsMarketPrice")
-
-	s.Price = s.Green.Price
-	s.Money1 = s.Red.Supply.Amount
-	s.Money2 = s.Green.give(s.Money1)
-
-	s.Red.Supply.Amount = 0
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount -= s.Money1
-
-	s.Green.Supply.Amount -= s.Money2
-	s.Red.Want.Amount = 0
-	s.Red.Received.Amount += s.Money2
-
-	s.Red.close()
-}
-
-func (s *Swap) case9() {
-	fmt.Println("Red.Supply = Green.Want")
-	fmt.Println("Red.IsMarketPrice")
-
-	s.Price = s.Green.Price
-	s.Money1 = s.Red.Supply.Amount
-	s.Money2 = s.Green.Supply.Amount
-
-	s.Red.Supply.Amount = 0
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount = 0
-
-	s.Green.Supply.Amount = 0
-	s.Red.Want.Amount = 0
-	s.Red.Received.Amount += s.Money2
-
-	s.Red.close()
-	s.Green.close()
-}
-
-func (s *Swap) case10() {
-	fmt.Println("Green.Supply = red.Want")
-	fmt.Println("Green.IsMarketPrice")
-
-	s.Price = s.Red.Price
-	s.Money1 = s.Red.Supply.Amount
-	s.Money2 = s.Green.Supply.Amount
-
-	s.Red.Supply.Amount = 0
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount = 0
-
-	s.Green.Supply.Amount = 0
-	s.Red.Want.Amount = 0
-	s.Red.Received.Amount += s.Money2
-
-	s.Red.close()
-	s.Green.close()
-}
-
-func (s *Swap) case11() {
-	fmt.Println("Red.Supply > Green.Want")
-	fmt.Println("Green.Supply = Red.Want")
-
-	s.Price = s.Green.Price
-	s.Money1 = s.Green.Want.Amount
-	s.Money2 = s.Green.Supply.Amount
-
-	s.Remainder1 = s.Red.Supply.Amount - s.Green.Want.Amount
-
-	s.Red.Supply.Amount = 0
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount = 0
-
-	s.Green.Supply.Amount = 0
-	s.Red.Want.Amount = 0
-	s.Red.Received.Amount += s.Money2
-
-	s.Red.close()
-	s.Green.close()
-	s.pair.curr1volume -= s.Remainder1
-}
-
-func (s *Swap) case12() {
-	fmt.Println("Green.Supply = Red.Want")
-	fmt.Println("Red.Supply = Green.Want")
-
-	s.Price = s.Red.Price
-	s.Money1 = s.Red.Supply.Amount
-	s.Money2 = s.Red.Want.Amount
-
-	s.Red.Supply.Amount = 0
-	s.Green.Received.Amount += s.Money1
-	s.Green.Want.Amount = 0
-
-	s.Green.Supply.Amount = 0
-	s.Red.Want.Amount = 0
-	s.Red.Received.Amount += s.Money2
-
-	s.Red.close()
-	s.Green.close()
-}
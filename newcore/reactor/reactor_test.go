@@ -0,0 +1,194 @@
+package reactor
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCurrencies(t *testing.T) {
+	m := CreateMarket()
+	if _, err := m.AddCurrency("USD", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddCurrency("USD", 4); !errors.Is(err, ErrDuplicateCurrency) {
+		t.Fatalf("USD added twice got %v", err)
+	}
+	if _, err := m.AddCurrency("ETH", MaxDecimal+1); !errors.Is(err, ErrInvalidCurrency) {
+		t.Fatalf("currency with %d decimals got %v", MaxDecimal+1, err)
+	}
+	m.AddCurrency("BTC", 8)
+	m.AddCurrency("WEI", MaxDecimal)
+
+	var names []string
+	for _, currency := range m.Currencies() {
+		names = append(names, currency.Name)
+	}
+	if len(names) != 3 || names[0] != "BTC" || names[1] != "USD" || names[2] != "WEI" {
+		t.Fatalf("currencies are %v, want BTC, USD and WEI", names)
+	}
+	if usd, _ := m.Currency("USD"); usd.Decimal != 2 || usd.fraction != 100 {
+		t.Fatalf("USD is %+v after adding it twice", usd)
+	}
+
+	if _, err := m.AddPair("BTC", "EUR"); !errors.Is(err, ErrUnknownCurrency) {
+		t.Fatalf("pair with an unknown currency got %v", err)
+	}
+	if _, err := m.AddPair("BTC", "BTC"); !errors.Is(err, ErrInvalidPair) {
+		t.Fatalf("pair of one currency got %v", err)
+	}
+	if _, err := m.AddPair("WEI", "USD"); !errors.Is(err, ErrInvalidPair) {
+		t.Fatalf("pair above %d decimals got %v", MaxPairDecimal, err)
+	}
+	m.AddCurrency("ETH", 16)
+	if _, err := m.AddPair("ETH", "USD"); !errors.Is(err, ErrInvalidPair) {
+		t.Fatalf("ETH/USD with 18 decimals got %v", err)
+	}
+	pair, err := m.AddPair("BTC", "USD")
+	if err != nil || pair.Name() != "BTC/USD" {
+		t.Fatalf("BTC/USD is %+v, %v", pair, err)
+	}
+	if price, ok := pair.calcPrice(1e8, 300000, RoundDown); !ok || price != 3000*1e10 {
+		t.Fatalf("1 BTC for 3000 USD priced %d, %t", price, ok)
+	}
+	if _, err := m.AddPair("BTC", "USD"); !errors.Is(err, ErrDuplicatePair) {
+		t.Fatalf("BTC/USD added twice got %v", err)
+	}
+}
+
+// TestSwapPrecision trades between currencies of different precision and
+// checks that every amount keeps the precision of its own currency.
+func TestSwapPrecision(t *testing.T) {
+	m := CreateMarket()
+	m.AddCurrency("BTC", 8)
+	m.AddCurrency("USD", 2)
+	m.AddPair("BTC", "USD")
+
+	m.AddNewOrderString(1, "", "BTC/USD", false, "0.5", "30000.5")
+	sell := m.orderMap[1]
+	if sell.Price != 60001*1e10 || sell.Supply.Amount != 50000000 || sell.Want.Amount != 3000050 {
+		t.Fatalf("sell 0.5 BTC for 30000.5 USD is %+v", sell)
+	}
+
+	events, err := m.AddNewOrderString(2, "", "BTC/USD", true, "0.2", "12000.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var swap *Swap
+	for _, e := range events {
+		if e.EventType == SwapOrder {
+			swap = e.Swap
+		}
+	}
+	if swap == nil {
+		t.Fatal("buy at the same price did not swap")
+	}
+	if swap.Money1 != 20000000 || swap.Money2 != 1200020 || swap.Price != 60001*1e10 {
+		t.Fatalf("swap of 0.2 BTC for 12000.2 USD is %+v", swap)
+	}
+	if sell.Supply.Amount != 30000000 || sell.Received.Amount != 1200020 {
+		t.Fatalf("sell has %+v after selling 0.2 BTC", sell)
+	}
+}
+
+// TestSameTerms places a buy and a sell with the same terms, whose prices
+// round to one apart, and checks that they trade in either order.
+func TestSameTerms(t *testing.T) {
+	tests := []struct {
+		sell, buy [2]string
+		bought    uint64
+	}{
+		{[2]string{"0.3", "1000"}, [2]string{"0.3", "1000"}, 30000000},
+		{[2]string{"1", "65000.01"}, [2]string{"1", "65000.01"}, 100000000},
+		{[2]string{"0.3", "1000"}, [2]string{"0.6", "2000"}, 30000000},
+	}
+	for _, test := range tests {
+		for _, sellFirst := range []bool{true, false} {
+			m := CreateMarket(WithInvariantMode(InvariantPanic))
+			m.AddCurrency("BTC", 8)
+			m.AddCurrency("USD", 2)
+			m.AddPair("BTC", "USD")
+			sell := func() ([]Event, error) {
+				return m.AddNewOrderString(1, "", "BTC/USD", false, test.sell[0], test.sell[1])
+			}
+			buy := func() ([]Event, error) {
+				return m.AddNewOrderString(2, "", "BTC/USD", true, test.buy[0], test.buy[1])
+			}
+			first, second := sell, buy
+			if !sellFirst {
+				first, second = buy, sell
+			}
+			first()
+			events, err := second()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var swap *Swap
+			for _, e := range events {
+				if e.EventType == SwapOrder {
+					swap = e.Swap
+				}
+			}
+			if swap == nil || swap.Money1 != test.bought {
+				t.Errorf("sell %s BTC for %s and buy %s for %s, sell first %t, swapped %+v",
+					test.sell[0], test.sell[1], test.buy[0], test.buy[1], sellFirst, swap)
+			}
+		}
+	}
+}
+
+// TestMarketsAreIndependent runs the same orders on two markets.
+func TestMarketsAreIndependent(t *testing.T) {
+	markets := []*Market{CreateMarket(), CreateMarket()}
+	for _, m := range markets {
+		m.AddCurrency("AAA", 0)
+		m.AddCurrency("BBB", 0)
+		m.AddPair("AAA", "BBB")
+		m.AddNewOrder(1, "", "AAA/BBB", false, 10, 100)
+	}
+	if _, err := markets[0].AddNewOrder(2, "", "AAA/BBB", true, 10, 100); err != nil {
+		t.Fatal(err)
+	}
+	events, _ := markets[1].AddNewOrder(2, "", "AAA/BBB", true, 5, 50)
+	if len(events) < 2 || events[1].EventType != SwapOrder || events[1].Swap.Money1 != 5 {
+		t.Fatalf("second market answered %+v", events)
+	}
+	if events[0].Id != 3 {
+		t.Fatalf("second market numbered its event %d, want 3 after the events of order 1", events[0].Id)
+	}
+	if !markets[0].orderMap[1].IsClose || markets[1].orderMap[1].IsClose {
+		t.Fatal("a swap on one market closed the order on the other")
+	}
+}
+
+func TestCancelOrder(t *testing.T) {
+	m := CreateMarket()
+	m.SetInvariantMode(InvariantPanic)
+	m.AddCurrency("AAA", 0)
+	m.AddCurrency("BBB", 0)
+	pair, _ := m.AddPair("AAA", "BBB")
+	m.AddNewOrder(1, "", "AAA/BBB", false, 10, 100)
+	m.AddNewOrder(2, "", "AAA/BBB", false, 10, 100)
+	m.AddNewOrder(3, "", "AAA/BBB", true, 10, 100)
+
+	events, err := m.CancelOrder(2)
+	if err != nil || len(events) == 0 || events[0].EventType != Cancel || events[0].Order.Id != 2 {
+		t.Fatalf("cancel of a resting order answered %+v, %v", events, err)
+	}
+	if pair.sellStack.len() != 0 || pair.curr1volume != 0 {
+		t.Fatalf("book keeps %d orders and %d AAA after the cancel", pair.sellStack.len(), pair.curr1volume)
+	}
+	for _, id := range []uint64{1, 2} {
+		events, err = m.CancelOrder(id)
+		if !errors.Is(err, ErrOrderClosed) || events[0].Order == nil || events[0].Order.Id != id {
+			t.Fatalf("cancel of closed order %d answered %+v, %v", id, events, err)
+		}
+	}
+
+	m.AddNewOrder(4, "alice", "AAA/BBB", false, 10, 100)
+	if _, err := m.CancelOwnOrder(4, "bob"); !errors.Is(err, ErrUnknownOrder) {
+		t.Fatalf("cancel of the order of another owner got %v", err)
+	}
+	if _, err := m.CancelOwnOrder(4, "alice"); err != nil {
+		t.Fatalf("cancel of an own order got %v", err)
+	}
+}
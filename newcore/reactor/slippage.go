@@ -0,0 +1,94 @@
+package reactor
+
+import (
+	"math"
+	"math/big"
+)
+
+// SlippageScale is the unit of slippage bands: a band of 10000 is 1% of the
+// reference price.
+const SlippageScale = 1000000
+
+// SlippageReference is the price a slippage band is measured from.
+type SlippageReference string
+
+const (
+	// FromBestPrice measures from the best price on the other side of the
+	// book when the market order comes in. It is the default.
+	FromBestPrice SlippageReference = "best"
+	// FromLastTrade measures from the price of the last swap of the pair,
+	// or from the best price while the pair has not traded yet.
+	FromLastTrade SlippageReference = "last"
+)
+
+// SlippageBand caps how far a market order may walk the book of a pair. The
+// order only trades with resting orders whose price is at most Max worse than
+// the reference price, and whatever is left of it when the next one is
+// outside the band is cancelled with CancelSlippage.
+type SlippageBand struct {
+	Max       uint64            `json:"max"`
+	Reference SlippageReference `json:"reference"`
+}
+
+// SetSlippageBand replaces the slippage band of a pair. It applies to the
+// market orders that follow.
+func (m *Market) SetSlippageBand(pairName string, band SlippageBand) error {
+	pair, exists := m.pairMap[pairName]
+	if !exists {
+		return newError(ErrUnknownPair, "pair %s not found", pairName)
+	}
+	switch band.Reference {
+	case "":
+		band.Reference = FromBestPrice
+	case FromBestPrice, FromLastTrade:
+	default:
+		return newError(ErrInvalidSlippage, "slippage reference %q not supported", band.Reference)
+	}
+	if band.Max > SlippageScale {
+		return newError(ErrInvalidSlippage, "slippage above %d not allowed", SlippageScale)
+	}
+	pair.slippage = &band
+	return nil
+}
+
+// setBand works out the worst price a market order may trade at when it
+// comes in.
+func (o *Order) setBand() {
+	p := o.pair
+	if p.slippage == nil || !o.IsMarketPrice {
+		return
+	}
+	best := p.buyStack.best()
+	if o.IsGreen {
+		best = p.sellStack.best()
+	}
+	if best == nil {
+		return
+	}
+	reference := best.Price
+	if p.slippage.Reference == FromLastTrade && p.lastPrice != 0 {
+		reference = p.lastPrice
+	}
+	offset, ok := mulDiv(reference, new(big.Int).SetUint64(p.slippage.Max), SlippageScale, RoundDown)
+	if !ok {
+		offset = math.MaxUint64
+	}
+	o.banded = true
+	if o.IsGreen {
+		o.bandPrice = addSaturated(reference, offset)
+	} else {
+		o.bandPrice = reference - offset
+	}
+}
+
+// withinBand tells whether the order may trade with resting without going
+// past its slippage band.
+func (o *Order) withinBand(resting *Order) bool {
+	if !o.banded {
+		return true
+	}
+	if o.IsGreen {
+		return resting.Price <= o.bandPrice
+	}
+	return resting.Price >= o.bandPrice
+}
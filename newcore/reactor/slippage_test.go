@@ -0,0 +1,60 @@
+package reactor
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSlippageBand(t *testing.T) {
+	m, _ := newTestMarket(t)
+	tr := newTranscript(t)
+
+	if err := m.SetSlippageBand(testPair, SlippageBand{Max: SlippageScale + 1}); !errors.Is(err, ErrInvalidSlippage) {
+		t.Fatalf("band above the scale got %v, want %v", err, ErrInvalidSlippage)
+	}
+	// 5% of the best price.
+	if err := m.SetSlippageBand(testPair, SlippageBand{Max: 50000}); err != nil {
+		t.Fatal(err)
+	}
+	tr.step("sell 10 for 1000").record(m.AddNewOrder(1, "a", testPair, false, 10, 1000))
+	tr.step("sell 10 for 1040").record(m.AddNewOrder(2, "a", testPair, false, 10, 1040))
+	tr.step("sell 10 for 1100").record(m.AddNewOrder(3, "a", testPair, false, 10, 1100))
+
+	events, _ := tr.step("market buy for 3000").record(m.AddNewOrder(4, "b", testPair, true, 0, 3000))
+	if n := countEvents(events, SwapOrder); n != 2 {
+		t.Fatalf("market order swapped %d times within the band, want 2", n)
+	}
+	cancel := findEvent(t, events, Cancel)
+	if cancel.Reason != CancelSlippage || cancel.Unfilled.Amount != 3000-1000-1040 {
+		t.Fatalf("market order ends with %+v, want a cancel for slippage", cancel)
+	}
+	if depth, _ := m.Depth(testPair, 0); len(depth.Asks) != 1 || depth.Asks[0].Price != 110 {
+		t.Fatalf("asks after the market order are %+v, want only 110 left", depth.Asks)
+	}
+	tr.check("slippage")
+}
+
+func TestSlippageBandFromLastTrade(t *testing.T) {
+	m, _ := newTestMarket(t)
+	tr := newTranscript(t)
+
+	if err := m.SetSlippageBand(testPair, SlippageBand{Max: 50000, Reference: FromLastTrade}); err != nil {
+		t.Fatal(err)
+	}
+	tr.step("sell 10 for 1000").record(m.AddNewOrder(1, "a", testPair, false, 10, 1000))
+	tr.step("buy 10 for 1000").record(m.AddNewOrder(2, "b", testPair, true, 10, 1000))
+	if m.pairMap[testPair].lastPrice != 100 {
+		t.Fatalf("last price is %d, want 100", m.pairMap[testPair].lastPrice)
+	}
+
+	// The best ask is within 5% of itself but not of the last trade.
+	tr.step("sell 10 for 1100").record(m.AddNewOrder(3, "a", testPair, false, 10, 1100))
+	events, _ := tr.step("market buy for 1100").record(m.AddNewOrder(4, "b", testPair, true, 0, 1100))
+	if n := countEvents(events, SwapOrder); n != 0 {
+		t.Fatalf("market order swapped %d times outside the band, want none", n)
+	}
+	if cancel := findEvent(t, events, Cancel); cancel.Reason != CancelSlippage {
+		t.Fatalf("market order ends with %+v, want a cancel for slippage", cancel)
+	}
+	tr.check("slippage_last")
+}
@@ -0,0 +1,232 @@
+package reactor
+
+import (
+	"container/heap"
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// SnapshotVersion is written into every snapshot. Load refuses snapshots of
+// any other version, so it goes up with every change to what a snapshot
+// holds. Version 2 added the time of orders, version 3 the account ledger,
+// version 4 its transfers, version 5 fees and trading volumes, version 6 the
+// refunds of orders, version 7 their time in force, version 8 the protection
+// price of market orders, version 9 slippage bands and last prices and
+// version 10 the amounts limit orders were placed with.
+const SnapshotVersion = 10
+
+// snapshot is the complete state of a market. Books are kept as the ids of
+// their resting orders in priority order, so loading them again restores the
+// time priority within every price level.
+type snapshot struct {
+	Version     int               `json:"version"`
+	LastEventId uint64            `json:"lastEventId"`
+	LastSeq     uint64            `json:"lastSeq"`
+	Currencies  []Currency        `json:"currencies"`
+	Pairs       []pairSnapshot    `json:"pairs"`
+	Orders      []orderSnapshot   `json:"orders"`
+	Remainders  map[string]uint64 `json:"remainders"`
+	Fees        map[string]uint64 `json:"fees"`
+	Ledger      *ledgerSnapshot   `json:"ledger,omitempty"`
+}
+
+type ledgerSnapshot struct {
+	Accounts  map[string][]Balance `json:"accounts"`
+	Deposited map[string]uint64    `json:"deposited"`
+	Transfers []Transfer           `json:"transfers"`
+}
+
+type pairSnapshot struct {
+	Currency1 string            `json:"currency1"`
+	Currency2 string            `json:"currency2"`
+	Seq       uint64            `json:"seq"`
+	Volume1   uint64            `json:"volume1"`
+	Volume2   uint64            `json:"volume2"`
+	Bids      []uint64          `json:"bids"`
+	Asks      []uint64          `json:"asks"`
+	Fees      *FeeSchedule      `json:"fees,omitempty"`
+	Volumes   map[string]uint64 `json:"volumes"`
+	LastPrice uint64            `json:"lastPrice,omitempty"`
+	Slippage  *SlippageBand     `json:"slippage,omitempty"`
+}
+
+type orderSnapshot struct {
+	Order
+	Supplied uint64 `json:"supplied"`
+	Wanted   uint64 `json:"wanted"`
+}
+
+// Save writes the state of the market to w.
+func (m *Market) Save(w io.Writer) error {
+	s := snapshot{
+		Version:     SnapshotVersion,
+		LastEventId: m.lastEventId,
+		LastSeq:     m.lastSeq,
+		Currencies:  make([]Currency, 0, len(m.currencyMap)),
+		Pairs:       make([]pairSnapshot, 0, len(m.pairMap)),
+		Orders:      make([]orderSnapshot, 0, len(m.orderMap)),
+		Remainders:  m.remainders,
+		Fees:        m.fees,
+	}
+	for _, currency := range m.Currencies() {
+		s.Currencies = append(s.Currencies, *currency)
+	}
+	for _, pair := range m.pairMap {
+		s.Pairs = append(s.Pairs, pairSnapshot{
+			Currency1: pair.currency1.Name,
+			Currency2: pair.currency2.Name,
+			Seq:       pair.seq,
+			Volume1:   pair.curr1volume,
+			Volume2:   pair.curr2volume,
+			Bids:      pair.buyStack.ids(),
+			Asks:      pair.sellStack.ids(),
+			Fees:      pair.fees,
+			Volumes:   pair.volumes,
+			LastPrice: pair.lastPrice,
+			Slippage:  pair.slippage,
+		})
+	}
+	sort.Slice(s.Pairs, func(i, j int) bool {
+		return s.Pairs[i].Currency1+"/"+s.Pairs[i].Currency2 < s.Pairs[j].Currency1+"/"+s.Pairs[j].Currency2
+	})
+	for _, order := range m.orderMap {
+		s.Orders = append(s.Orders, orderSnapshot{Order: *order, Supplied: order.supplied, Wanted: order.wanted})
+	}
+	sort.Slice(s.Orders, func(i, j int) bool { return s.Orders[i].Id < s.Orders[j].Id })
+	if m.ledger != nil {
+		s.Ledger = &ledgerSnapshot{
+			Accounts:  make(map[string][]Balance, len(m.ledger.accounts)),
+			Deposited: m.ledger.deposited,
+		}
+		for owner := range m.ledger.accounts {
+			s.Ledger.Accounts[owner], _ = m.Balances(owner)
+		}
+		s.Ledger.Transfers = make([]Transfer, 0, len(m.ledger.transfers))
+		for _, transfer := range m.ledger.transfers {
+			s.Ledger.Transfers = append(s.Ledger.Transfers, *transfer)
+		}
+		sort.Slice(s.Ledger.Transfers, func(i, j int) bool {
+			return s.Ledger.Transfers[i].TxId < s.Ledger.Transfers[j].TxId
+		})
+	}
+	return json.NewEncoder(w).Encode(s)
+}
+
+// Load restores a market written by Save. The market must be empty, as it is
+// after CreateMarket, and created with the same accounts option.
+func (m *Market) Load(r io.Reader) error {
+	if len(m.currencyMap) > 0 || len(m.orderMap) > 0 || m.lastEventId > 0 {
+		return newError(ErrInvalidSnapshot, "market is not empty")
+	}
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return newError(ErrInvalidSnapshot, "snapshot not readable: %v", err)
+	}
+	if s.Version != SnapshotVersion {
+		return newError(ErrInvalidSnapshot, "snapshot version %d not supported", s.Version)
+	}
+	if (s.Ledger != nil) != (m.ledger != nil) {
+		return newError(ErrInvalidSnapshot, "snapshot and market disagree on accounts")
+	}
+
+	for _, currency := range s.Currencies {
+		if _, err := m.AddCurrency(currency.Name, currency.Decimal); err != nil {
+			return err
+		}
+	}
+	for _, ps := range s.Pairs {
+		pair, err := m.AddPair(ps.Currency1, ps.Currency2)
+		if err != nil {
+			return err
+		}
+		pair.seq = ps.Seq
+		pair.curr1volume = ps.Volume1
+		pair.curr2volume = ps.Volume2
+		if ps.Fees != nil {
+			if err := m.SetFees(pair.Name(), *ps.Fees); err != nil {
+				return err
+			}
+		}
+		for owner, volume := range ps.Volumes {
+			pair.volumes[owner] = volume
+		}
+		pair.lastPrice = ps.LastPrice
+		if ps.Slippage != nil {
+			if err := m.SetSlippageBand(pair.Name(), *ps.Slippage); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range s.Orders {
+		order := s.Orders[i].Order
+		pair, exists := m.pairMap[order.PairName]
+		if !exists {
+			return newError(ErrInvalidSnapshot, "pair %s of order %d not found", order.PairName, order.Id)
+		}
+		if _, exists := m.orderMap[order.Id]; exists {
+			return newError(ErrInvalidSnapshot, "order %d appears twice", order.Id)
+		}
+		order.market = m
+		order.pair = pair
+		order.supplied = s.Orders[i].Supplied
+		order.wanted = s.Orders[i].Wanted
+		m.orderMap[order.Id] = &order
+	}
+	for _, ps := range s.Pairs {
+		pair := m.pairMap[ps.Currency1+"/"+ps.Currency2]
+		if err := m.loadBook(pair, pair.buyStack, ps.Bids, true); err != nil {
+			return err
+		}
+		if err := m.loadBook(pair, pair.sellStack, ps.Asks, false); err != nil {
+			return err
+		}
+	}
+
+	m.lastEventId = s.LastEventId
+	m.lastSeq = s.LastSeq
+	for currency, amount := range s.Remainders {
+		m.remainders[currency] = amount
+	}
+	for currency, amount := range s.Fees {
+		m.fees[currency] = amount
+	}
+	if s.Ledger != nil {
+		for owner, balances := range s.Ledger.Accounts {
+			for _, b := range balances {
+				*m.ledger.balance(owner, b.Currency) = b
+			}
+		}
+		for currency, amount := range s.Ledger.Deposited {
+			m.ledger.deposited[currency] = amount
+		}
+		for i := range s.Ledger.Transfers {
+			m.ledger.transfers[s.Ledger.Transfers[i].TxId] = &s.Ledger.Transfers[i]
+		}
+	}
+	return nil
+}
+
+func (m *Market) loadBook(pair *Pair, b *book, ids []uint64, isGreen bool) error {
+	for _, id := range ids {
+		order, exists := m.orderMap[id]
+		if !exists || order.pair != pair || order.IsClose || order.IsGreen != isGreen || order.level != nil {
+			return newError(ErrInvalidSnapshot, "order %d cannot rest in the book", id)
+		}
+		b.add(order)
+		if order.TimeInForce == GoodTillDate {
+			heap.Push(&m.expiries, order)
+		}
+	}
+	return nil
+}
+
+// ids lists the ids of the resting orders in priority order.
+func (b *book) ids() []uint64 {
+	list := make([]uint64, 0, b.len())
+	b.each(func(o *Order) bool {
+		list = append(list, o.Id)
+		return true
+	})
+	return list
+}
@@ -0,0 +1,124 @@
+package reactor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tradeAccounts funds two accounts and trades between them with fees, a
+// slippage band and a GTD order, leaving orders of both sides, a partial fill and two orders at
+// the same price on the book.
+func tradeAccounts(t *testing.T, m *Market, clock *FakeClock) {
+	t.Helper()
+	must := func(_ []Event, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(m.Deposit("tx1", "a", "AAA", 100))
+	must(m.Deposit("tx2", "b", "BBB", 10000))
+	must(m.Withdraw("tx3", "b", "BBB", 1000))
+	if err := m.SetFees(testPair, FeeSchedule{Maker: 1000, Taker: 2000, Tiers: []FeeTier{{Volume: 1000, Maker: 0, Taker: 1000}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetSlippageBand(testPair, SlippageBand{Max: 100000, Reference: FromLastTrade}); err != nil {
+		t.Fatal(err)
+	}
+	must(m.AddNewOrder(1, "a", testPair, false, 10, 1000))
+	must(m.AddNewOrder(2, "a", testPair, false, 10, 1000))
+	must(m.AddNewOrder(3, "a", testPair, false, 10, 1050, WithTimeInForce(GoodTillDate), WithExpireTime(clock.Now()+int64(time.Hour))))
+	clock.Advance(time.Second)
+	must(m.AddNewOrder(4, "b", testPair, true, 15, 1600))
+	must(m.AddNewOrder(5, "b", testPair, true, 10, 900))
+	must(m.AddNewOrder(6, "b", testPair, true, 0, 500))
+	must(m.AddNewOrder(7, "b", testPair, true, 5, 450))
+	must(m.CancelOrder(7))
+}
+
+func TestSnapshotSaveLoadSave(t *testing.T) {
+	m, clock := newTestMarket(t, WithAccounts())
+	tradeAccounts(t, m, clock)
+
+	var saved bytes.Buffer
+	if err := m.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	loaded := CreateMarket(WithClock(clock), WithInvariantMode(InvariantPanic), WithAccounts())
+	if err := loaded.Load(bytes.NewReader(saved.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	var resaved bytes.Buffer
+	if err := loaded.Save(&resaved); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved.Bytes(), resaved.Bytes()) {
+		t.Fatalf("snapshot changed on load:\nsaved   %s\nresaved %s", saved.Bytes(), resaved.Bytes())
+	}
+
+	// Both markets go on the same way: same priorities, ids, volumes,
+	// times, fees, band, balances and expiry.
+	next := []func(m *Market) ([]Event, error){
+		func(m *Market) ([]Event, error) { return m.AddNewOrder(8, "b", testPair, true, 0, 500) },
+		func(m *Market) ([]Event, error) { return m.AddNewOrder(9, "a", testPair, false, 5, 400) },
+		func(m *Market) ([]Event, error) { return m.CancelOrder(5) },
+		func(m *Market) ([]Event, error) { return m.Expire() },
+		func(m *Market) ([]Event, error) { return m.Withdraw("tx4", "a", "BBB", 100) },
+	}
+	for i, command := range next {
+		clock.Advance(time.Second)
+		if i == 3 {
+			clock.Advance(time.Hour)
+		}
+		events, err := command(m)
+		want, _ := json.Marshal(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err = command(loaded)
+		got, _ := json.Marshal(events)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("command %d after loading gives\n%s\nwant\n%s", i, got, want)
+		}
+	}
+
+	for _, owner := range []string{"a", "b", HouseAccount} {
+		want, _ := m.Balances(owner)
+		got, _ := loaded.Balances(owner)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s has %+v after loading, want %+v", owner, got, want)
+		}
+	}
+
+	if err := loaded.Load(bytes.NewReader(saved.Bytes())); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("loading into a market in use got %v, want %v", err, ErrInvalidSnapshot)
+	}
+	if err := CreateMarket().Load(bytes.NewReader(saved.Bytes())); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("loading accounts into a market without them got %v, want %v", err, ErrInvalidSnapshot)
+	}
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	var saved bytes.Buffer
+	if err := CreateMarket().Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	version := fmt.Sprintf(`"version":%d`, SnapshotVersion)
+	old := strings.Replace(saved.String(), version, fmt.Sprintf(`"version":%d`, SnapshotVersion-1), 1)
+	if old == saved.String() {
+		t.Fatalf("snapshot has no %s: %s", version, saved.String())
+	}
+	err := CreateMarket().Load(strings.NewReader(old))
+	if !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("loading an older snapshot got %v, want %v", err, ErrInvalidSnapshot)
+	}
+}
@@ -0,0 +1,161 @@
+package reactor
+
+import "container/heap"
+
+// TimeInForce says how long an order stays on the book.
+type TimeInForce string
+
+const (
+	// GoodTillCancel orders rest until they are filled or cancelled. It is
+	// the default.
+	GoodTillCancel TimeInForce = "GTC"
+	// ImmediateOrCancel orders trade what they can against the book when
+	// they come in, and whatever is left of them is cancelled.
+	ImmediateOrCancel TimeInForce = "IOC"
+	// FillOrKill orders are refused with ErrNotFillable unless the book can
+	// fill them completely when they come in.
+	FillOrKill TimeInForce = "FOK"
+	// GoodTillDate orders rest until their ExpireTime, then they are
+	// cancelled by the next command or Expire.
+	GoodTillDate TimeInForce = "GTD"
+)
+
+// CancelReason tells why a Cancel event took an order off the book. It is
+// empty for orders cancelled with CancelOrder.
+type CancelReason string
+
+const (
+	CancelUnfilled CancelReason = "unfilled"
+	CancelExpired  CancelReason = "expired"
+	// CancelSlippage cancels what is left of a market order when the book
+	// has nothing more within its slippage band, see SlippageBand.
+	CancelSlippage CancelReason = "slippage"
+)
+
+// OrderOption sets an optional property of an order in AddNewOrder. An
+// option that does not fit the order refuses it with an error.
+type OrderOption func(o *Order) *MarketError
+
+func WithTimeInForce(timeInForce TimeInForce) OrderOption {
+	return func(o *Order) *MarketError {
+		o.TimeInForce = timeInForce
+		return nil
+	}
+}
+
+// WithExpireTime sets when a GoodTillDate order expires, in Unix nanoseconds
+// of the market clock.
+func WithExpireTime(expireTime int64) OrderOption {
+	return func(o *Order) *MarketError {
+		o.ExpireTime = expireTime
+		return nil
+	}
+}
+
+func (o *Order) checkTimeInForce() *MarketError {
+	switch o.TimeInForce {
+	case "":
+		o.TimeInForce = GoodTillCancel
+	case GoodTillCancel, ImmediateOrCancel, FillOrKill, GoodTillDate:
+	default:
+		return newError(ErrInvalidTimeInForce, "time in force %q not supported", o.TimeInForce)
+	}
+	if o.TimeInForce == GoodTillDate {
+		if o.ExpireTime <= o.Time {
+			return newError(ErrInvalidTimeInForce, "order expires at %d, before it is placed", o.ExpireTime)
+		}
+	} else if o.ExpireTime != 0 {
+		return newError(ErrInvalidTimeInForce, "only %s orders expire", GoodTillDate)
+	}
+	return nil
+}
+
+// fillable tells whether the orders resting on the other side of the book
+// would fill the order completely. It matches copies of them the way swap
+// does, so nothing in the market changes.
+func (o *Order) fillable() bool {
+	taker := o.detached()
+	stack := o.pair.buyStack
+	if o.IsGreen {
+		stack = o.pair.sellStack
+	}
+	filled := false
+	stack.each(func(resting *Order) bool {
+		maker := resting.detached()
+		swap := Swap{market: o.market, pair: o.pair, Green: maker, Red: taker}
+		if o.IsGreen {
+			swap.Green, swap.Red = taker, maker
+		}
+		if !swap.crossed() || !taker.withinBand(maker) {
+			return false
+		}
+		swap.match()
+		filled = taker.filled()
+		return !filled
+	})
+	return filled
+}
+
+// NextExpiry returns the earliest ExpireTime of the resting GoodTillDate
+// orders, and false when there are none.
+func (m *Market) NextExpiry() (int64, bool) {
+	for len(m.expiries) > 0 {
+		if order := m.expiries[0]; !order.IsClose {
+			return order.ExpireTime, true
+		}
+		heap.Pop(&m.expiries)
+	}
+	return 0, false
+}
+
+// Expire cancels the GoodTillDate orders whose ExpireTime has come. Every
+// command does so before anything else, Expire is for the time in between.
+func (m *Market) Expire() ([]Event, error) {
+	m.lastEvents = m.lastEvents[:0]
+	m.expire()
+	m.flushDeltas()
+	m.checkInvariants()
+	return m.lastEvents, nil
+}
+
+func (m *Market) expire() {
+	now := m.now()
+	for len(m.expiries) > 0 && m.expiries[0].ExpireTime <= now {
+		order := heap.Pop(&m.expiries).(*Order)
+		if !order.IsClose {
+			m.cancel(order, CancelExpired)
+		}
+	}
+}
+
+// expiryQueue keeps the GoodTillDate orders with the earliest ExpireTime
+// first. Orders that closed before they expired are dropped when they come
+// up.
+type expiryQueue []*Order
+
+func (q expiryQueue) Len() int {
+	return len(q)
+}
+
+func (q expiryQueue) Less(i, j int) bool {
+	if q[i].ExpireTime != q[j].ExpireTime {
+		return q[i].ExpireTime < q[j].ExpireTime
+	}
+	return q[i].Seq < q[j].Seq
+}
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	*q = append(*q, x.(*Order))
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	order := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return order
+}
@@ -0,0 +1,100 @@
+package reactor
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestImmediateOrCancel(t *testing.T) {
+	m, _ := newTestMarket(t)
+	tr := newTranscript(t)
+
+	tr.step("sell 10 for 100").record(m.AddNewOrder(1, "a", testPair, false, 10, 100))
+	events, _ := tr.step("IOC buy 15 for 150").record(m.AddNewOrder(2, "b", testPair, true, 15, 150, WithTimeInForce(ImmediateOrCancel)))
+	if countEvents(events, SwapOrder) != 1 {
+		t.Fatalf("IOC order swapped %d times, want 1", countEvents(events, SwapOrder))
+	}
+	cancel := findEvent(t, events, Cancel)
+	if cancel.EventType != Cancel || cancel.Reason != CancelUnfilled || cancel.Unfilled.Amount != 50 {
+		t.Fatalf("IOC order ends with %+v, want a cancel of 50 unfilled", cancel)
+	}
+
+	events, _ = tr.step("IOC buy 5 for 50 on an empty book").record(m.AddNewOrder(3, "b", testPair, true, 5, 50, WithTimeInForce(ImmediateOrCancel)))
+	if countEvents(events, BookDelta) != 0 {
+		t.Fatalf("unfilled IOC order gave %d book deltas, want none", countEvents(events, BookDelta))
+	}
+	tr.check("ioc")
+}
+
+func TestFillOrKill(t *testing.T) {
+	m, _ := newTestMarket(t)
+	tr := newTranscript(t)
+
+	tr.step("sell 10 for 100").record(m.AddNewOrder(1, "a", testPair, false, 10, 100))
+	tr.step("sell 10 for 110").record(m.AddNewOrder(2, "a", testPair, false, 10, 110))
+	_, err := tr.step("FOK buy 15 for 150").record(m.AddNewOrder(3, "b", testPair, true, 15, 150, WithTimeInForce(FillOrKill)))
+	if !errors.Is(err, ErrNotFillable) {
+		t.Fatalf("FOK order beyond its price got %v, want %v", err, ErrNotFillable)
+	}
+	if depth, _ := m.Depth(testPair, 0); len(depth.Asks) != 2 || depth.Asks[0].Amount1 != 10 {
+		t.Fatalf("refused FOK order changed the asks: %+v", depth.Asks)
+	}
+
+	events, _ := tr.step("FOK buy 15 for 170").record(m.AddNewOrder(4, "b", testPair, true, 15, 170, WithTimeInForce(FillOrKill)))
+	if countEvents(events, SwapOrder) != 2 || countEvents(events, Cancel) != 0 {
+		t.Fatalf("fillable FOK order gave %d swaps and %d cancels, want 2 and none",
+			countEvents(events, SwapOrder), countEvents(events, Cancel))
+	}
+	if order := m.orderMap[4]; !order.IsClose || order.Received.Amount != 15 {
+		t.Fatalf("FOK order ends as %+v, want 15 received", order)
+	}
+	tr.check("fok")
+}
+
+func TestGoodTillDate(t *testing.T) {
+	m, clock := newTestMarket(t)
+	tr := newTranscript(t)
+	start := clock.Now()
+
+	_, err := tr.step("GTD sell expiring now").record(m.AddNewOrder(1, "a", testPair, false, 10, 100,
+		WithTimeInForce(GoodTillDate), WithExpireTime(start)))
+	if !errors.Is(err, ErrInvalidTimeInForce) {
+		t.Fatalf("GTD order expiring when it is placed got %v, want %v", err, ErrInvalidTimeInForce)
+	}
+	_, err = tr.step("GTC sell with an expire time").record(m.AddNewOrder(2, "a", testPair, false, 10, 100,
+		WithExpireTime(start+int64(time.Minute))))
+	if !errors.Is(err, ErrInvalidTimeInForce) {
+		t.Fatalf("GTC order with an expire time got %v, want %v", err, ErrInvalidTimeInForce)
+	}
+
+	tr.step("GTD sell expiring in 2 minutes").record(m.AddNewOrder(3, "a", testPair, false, 10, 100,
+		WithTimeInForce(GoodTillDate), WithExpireTime(start+int64(2*time.Minute))))
+	tr.step("GTD sell expiring in 1 minute").record(m.AddNewOrder(4, "a", testPair, false, 10, 110,
+		WithTimeInForce(GoodTillDate), WithExpireTime(start+int64(time.Minute))))
+	if next, ok := m.NextExpiry(); !ok || next != start+int64(time.Minute) {
+		t.Fatalf("next expiry is %d, %v, want %d", next, ok, start+int64(time.Minute))
+	}
+
+	clock.Advance(time.Minute)
+	events, _ := tr.step("expire after 1 minute").record(m.Expire())
+	if cancel := findEvent(t, events, Cancel); cancel.Reason != CancelExpired || cancel.Order.Id != 4 {
+		t.Fatalf("expire gave %+v, want order 4 cancelled as expired", cancel)
+	}
+	if next, ok := m.NextExpiry(); !ok || next != start+int64(2*time.Minute) {
+		t.Fatalf("next expiry is %d, %v, want %d", next, ok, start+int64(2*time.Minute))
+	}
+
+	clock.Advance(time.Minute)
+	events, err = tr.step("cancel order 4 after 2 minutes").record(m.CancelOrder(4))
+	if !errors.Is(err, ErrOrderClosed) {
+		t.Fatalf("cancelling an expired order got %v, want %v", err, ErrOrderClosed)
+	}
+	if cancel := findEvent(t, events, Cancel); cancel.Reason != CancelExpired || cancel.Order.Id != 3 {
+		t.Fatalf("command after the expiry began with %+v, want order 3 cancelled as expired", cancel)
+	}
+	if _, ok := m.NextExpiry(); ok {
+		t.Fatal("expiry left after every GTD order expired")
+	}
+	tr.check("gtd")
+}
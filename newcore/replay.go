@@ -0,0 +1,113 @@
+package main
+
+import (
+	"./journal"
+	"./reactor"
+	"./stackserver"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+)
+
+// replay runs the journal, after the snapshot if one is given, through a
+// fresh market and returns every event it gives. Each command runs under the
+// clock of the time it was first received, so the events are the ones the
+// stackserver sent.
+func replay() ([]reactor.Event, error) {
+	if *journalPath == "" {
+		return nil, fmt.Errorf("replay needs -journal")
+	}
+	market := reactor.CreateMarket(stackserver.MarketOptions(serverOptions())...)
+	var from uint64
+	if *snapshotPath != "" {
+		var err error
+		if from, err = stackserver.LoadSnapshot(market, *snapshotPath); err != nil {
+			return nil, err
+		}
+	}
+	var events []reactor.Event
+	err := stackserver.Replay(market, *journalPath, from, func(_ journal.Entry, list []reactor.Event) {
+		events = append(events, list...)
+	})
+	return events, err
+}
+
+// writeReplay writes the replayed events to out, one JSON object per line,
+// in the format of the stackserver event log.
+func writeReplay(out io.Writer) error {
+	events, err := replay()
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	for _, e := range events {
+		if err := encoder.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyReplay compares the replayed events with the event log at path and
+// reports the first one that differs. Logged events from before the snapshot
+// are skipped.
+func verifyReplay(path string) error {
+	events, err := replay()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	i := 0
+	for scanner.Scan() {
+		var logged map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &logged); err != nil {
+			return err
+		}
+		id, _ := logged["id"].(float64)
+		if i == 0 && len(events) > 0 && uint64(id) < events[0].Id {
+			continue
+		}
+		if i == len(events) {
+			return fmt.Errorf("event %d is logged but not replayed:\n%s", uint64(id), scanner.Bytes())
+		}
+		replayed, err := normalize(events[i])
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(logged, replayed) {
+			line, _ := json.Marshal(events[i])
+			return fmt.Errorf("event %d differs:\nlogged   %s\nreplayed %s", uint64(id), scanner.Bytes(), line)
+		}
+		i++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if i < len(events) {
+		line, _ := json.Marshal(events[i])
+		return fmt.Errorf("event %d is replayed but not logged:\n%s", events[i].Id, line)
+	}
+	fmt.Printf("%d events match \n", i)
+	return nil
+}
+
+// normalize turns an event into the generic form a logged line decodes to.
+func normalize(e reactor.Event) (map[string]interface{}, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	var v map[string]interface{}
+	err = json.Unmarshal(line, &v)
+	return v, err
+}
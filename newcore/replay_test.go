@@ -0,0 +1,68 @@
+package main
+
+import (
+	"./journal"
+	"./stackserver"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*journalPath = filepath.Join(dir, "journal")
+	defer func() { *journalPath = "" }()
+
+	j, err := journal.Open(*journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commands := []struct {
+		entryType string
+		data      interface{}
+	}{
+		{"currency", stackserver.CurrencyDTO{Name: "AAA", Decimal: 0}},
+		{"currency", stackserver.CurrencyDTO{Name: "BBB", Decimal: 0}},
+		{"pair", stackserver.PairDTO{Currency1: "AAA", Currency2: "BBB"}},
+		{"order", stackserver.OrderDTO{Id: 1, PairName: "AAA/BBB", Currency1: "10", Currency2: "100"}},
+		{"order", stackserver.OrderDTO{Id: 2, PairName: "AAA/BBB", IsGreen: true, Currency1: "4", Currency2: "40"}},
+		{"cancel", stackserver.CancelDTO{Id: 1}},
+	}
+	for i, command := range commands {
+		if _, err := j.Append(command.entryType, int64(i+1)*1000, command.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	var log bytes.Buffer
+	if err := writeReplay(&log); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), `"time":5000`) {
+		t.Fatalf("replayed events do not carry the journal time:\n%s", log.String())
+	}
+	eventLog := filepath.Join(dir, "events")
+	ioutil.WriteFile(eventLog, log.Bytes(), 0644)
+	if err := verifyReplay(eventLog); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := strings.Replace(log.String(), `"time":5000`, `"time":5001`, 1)
+	ioutil.WriteFile(eventLog, []byte(changed), 0644)
+	if err := verifyReplay(eventLog); err == nil || !strings.Contains(err.Error(), "differs") {
+		t.Fatalf("verify of a changed log got %v", err)
+	}
+	lines := strings.SplitAfter(log.String(), "\n")
+	ioutil.WriteFile(eventLog, []byte(strings.Join(lines[:len(lines)-2], "")), 0644)
+	if err := verifyReplay(eventLog); err == nil || !strings.Contains(err.Error(), "not logged") {
+		t.Fatalf("verify of a short log got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package stackserver
+
+import (
+	"../reactor"
+	"encoding/json"
+	"log"
+	"os"
+)
+
+var eventLog *json.Encoder
+
+func openEventLog(path string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	eventLog = json.NewEncoder(file)
+}
+
+// logEvents appends events to the event log. The log is a record to verify
+// replays against, recovery does not need it, so it is not synced.
+func logEvents(events []reactor.Event) {
+	if eventLog == nil {
+		return
+	}
+	for _, e := range events {
+		if err := eventLog.Encode(e); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+}
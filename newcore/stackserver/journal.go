@@ -0,0 +1,149 @@
+package stackserver
+
+import (
+	"../journal"
+	"../reactor"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// Journal entry types of the commands that change the market. Queries are not
+// journaled.
+const (
+	currencyEntry = "currency"
+	pairEntry     = "pair"
+	orderEntry    = "order"
+	cancelEntry   = "cancel"
+	expireEntry   = "expire"
+	depositEntry  = "deposit"
+	withdrawEntry = "withdraw"
+	feesEntry     = "fees"
+	slippageEntry = "slippage"
+)
+
+var commandJournal *journal.Journal
+
+func entryType(data interface{}) string {
+	switch data.(type) {
+	case CurrencyDTO:
+		return currencyEntry
+	case PairDTO:
+		return pairEntry
+	case OrderDTO:
+		return orderEntry
+	case CancelDTO:
+		return cancelEntry
+	case ExpireDTO:
+		return expireEntry
+	case DepositDTO:
+		return depositEntry
+	case WithdrawDTO:
+		return withdrawEntry
+	case FeesDTO:
+		return feesEntry
+	case SlippageDTO:
+		return slippageEntry
+	}
+	return ""
+}
+
+func decodeEntry(entry journal.Entry) (interface{}, error) {
+	var err error
+	switch entry.Type {
+	case currencyEntry:
+		var v CurrencyDTO
+		err = json.Unmarshal(entry.Data, &v)
+		return v, err
+	case pairEntry:
+		var v PairDTO
+		err = json.Unmarshal(entry.Data, &v)
+		return v, err
+	case orderEntry:
+		var v OrderDTO
+		err = json.Unmarshal(entry.Data, &v)
+		return v, err
+	case cancelEntry:
+		var v CancelDTO
+		err = json.Unmarshal(entry.Data, &v)
+		return v, err
+	case expireEntry:
+		var v ExpireDTO
+		err = json.Unmarshal(entry.Data, &v)
+		return v, err
+	case depositEntry:
+		var v DepositDTO
+		err = json.Unmarshal(entry.Data, &v)
+		return v, err
+	case withdrawEntry:
+		var v WithdrawDTO
+		err = json.Unmarshal(entry.Data, &v)
+		return v, err
+	case feesEntry:
+		var v FeesDTO
+		err = json.Unmarshal(entry.Data, &v)
+		return v, err
+	case slippageEntry:
+		var v SlippageDTO
+		err = json.Unmarshal(entry.Data, &v)
+		return v, err
+	}
+	return nil, fmt.Errorf("journal entry %d has unknown type %q", entry.Seq, entry.Type)
+}
+
+// openJournal opens the journal and replays the entries after seq from into
+// the market. Commands the market refused are journaled and replayed too, they
+// still take event ids. Events of replayed commands are not sent again.
+func openJournal(path string, from uint64) {
+	var err error
+	commandJournal, err = journal.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = commandJournal.Replay(from, replayer(market, nil))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Journal: replayed %d commands \n", commandJournal.Seq()-from)
+}
+
+// Replay applies the entries after seq from of the journal at path to m, the
+// way the server recovers from it, and hands the events of every entry to fn.
+// The journal file is not changed.
+func Replay(m *reactor.Market, path string, from uint64, fn func(journal.Entry, []reactor.Event)) error {
+	return journal.Read(path, from, replayer(m, fn))
+}
+
+// replayer applies journal entries to m. The clock of m is set to the time
+// an entry was received while it is applied, as it was when it first ran.
+func replayer(m *reactor.Market, fn func(journal.Entry, []reactor.Event)) func(journal.Entry) error {
+	clock := reactor.NewFakeClock(0)
+	m.SetClock(clock)
+	return func(entry journal.Entry) error {
+		data, err := decodeEntry(entry)
+		if err != nil {
+			return err
+		}
+		clock.Set(entry.Time)
+		reply := apply(m, data)
+		if fn != nil {
+			fn(entry, reply.Events)
+		}
+		return nil
+	}
+}
+
+// record writes a command changing the market to the journal. The returned
+// Reply carries an error if the command must not be applied.
+func record(data interface{}) Reply {
+	var reply Reply
+	entryType := entryType(data)
+	if commandJournal == nil || entryType == "" {
+		return reply
+	}
+	if _, err := commandJournal.Append(entryType, commandClock.Now(), data); err != nil {
+		log.Println(err)
+		reply.Error = &reactor.MarketError{Code: ErrJournal, Message: "command not journaled"}
+	}
+	return reply
+}
@@ -0,0 +1,189 @@
+package stackserver
+
+import (
+	"../journal"
+	"../reactor"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// journalCommands trade on a pair and include commands the market refuses.
+var journalCommands = []interface{}{
+	CurrencyDTO{Name: "BTC", Decimal: 8},
+	CurrencyDTO{Name: "USD", Decimal: 2},
+	PairDTO{Currency1: "BTC", Currency2: "USD"},
+	OrderDTO{Id: 1, Owner: "a", PairName: "BTC/USD", Currency1: "0.5", Currency2: "30000"},
+	OrderDTO{Id: 2, Owner: "a", PairName: "BTC/USD", Currency1: "0.5", Currency2: "31000", TimeInForce: reactor.GoodTillDate, ExpireTime: int64(29 * time.Second)},
+	OrderDTO{Id: 3, Owner: "b", PairName: "BTC/USD", IsGreen: true, Currency1: "0.2", Currency2: "12500.5"},
+	OrderDTO{Id: 3, Owner: "b", PairName: "BTC/USD", IsGreen: true, Currency1: "0.2", Currency2: "12500.5"},
+	CancelDTO{Id: 7},
+	OrderDTO{Id: 4, Owner: "b", PairName: "BTC/USD", IsGreen: true, Currency1: "0", Currency2: "20000", ProtectionPrice: "29000"},
+	CancelDTO{Id: 2},
+	OrderDTO{Id: 5, Owner: "b", PairName: "BTC/USD", IsGreen: true, Currency1: "1", Currency2: "29000"},
+}
+
+// marketState is what a replay has to restore: the book and the event ids.
+func marketState(t *testing.T) string {
+	t.Helper()
+	book, err := market.Book("BTC/USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := market.CancelOrder(0)
+	data, _ := json.Marshal(book)
+	return fmt.Sprintf("%s, next event %d", data, events[0].Id)
+}
+
+// runJournaled applies journalCommands the way the server does, with a
+// snapshot taken before command snapshotAt if it is positive, and returns the
+// state of the market.
+func runJournaled(t *testing.T, dir string, snapshotAt int) string {
+	t.Helper()
+	market = reactor.CreateMarket()
+	snapshotPath = filepath.Join(dir, "snapshot")
+	openJournal(filepath.Join(dir, "journal"), 0)
+	defer commandJournal.Close()
+	for i, data := range journalCommands {
+		if snapshotAt > 0 && i == snapshotAt {
+			if err := saveSnapshot(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if reply := record(data); reply.Error != nil {
+			t.Fatal(reply.Error)
+		}
+		apply(market, data)
+	}
+	return marketState(t)
+}
+
+// restart loads the market the way the server does on start.
+func restart(t *testing.T, dir string) string {
+	t.Helper()
+	market = reactor.CreateMarket()
+	from := loadSnapshot(filepath.Join(dir, "snapshot"))
+	openJournal(filepath.Join(dir, "journal"), from)
+	defer commandJournal.Close()
+	if seq := commandJournal.Seq(); seq != uint64(len(journalCommands)) {
+		t.Fatalf("journal ends at seq %d, want %d", seq, len(journalCommands))
+	}
+	return marketState(t)
+}
+
+// TestJournalEntries checks that every journaled command decodes back to
+// itself.
+func TestJournalEntries(t *testing.T) {
+	commands := append([]interface{}{
+		DepositDTO{TxId: "tx1", Account: "a", Currency: "USD", Amount: "10.5"},
+		WithdrawDTO{TxId: "tx2", Account: "a", Currency: "USD", Amount: "3"},
+		ExpireDTO{},
+		SlippageDTO{PairName: "BTC/USD", Band: reactor.SlippageBand{Max: 50000, Reference: reactor.FromLastTrade}},
+		FeesDTO{PairName: "BTC/USD", Fees: reactor.FeeSchedule{Maker: 1000, Tiers: []reactor.FeeTier{{Volume: 10, Taker: 5}}}},
+	}, journalCommands...)
+	for i, data := range commands {
+		encoded, _ := json.Marshal(data)
+		entry := journal.Entry{Seq: uint64(i + 1), Type: entryType(data), Data: encoded}
+		if decoded, err := decodeEntry(entry); err != nil || !reflect.DeepEqual(decoded, data) {
+			t.Fatalf("%T decodes to %+v, %v", data, decoded, err)
+		}
+	}
+}
+
+// TestJournalReplay checks that restarting from the journal alone, or from a
+// snapshot and the journal entries after it, restores the market.
+func TestJournalReplay(t *testing.T) {
+	saved := market
+	defer func() {
+		market = saved
+		commandJournal = nil
+		snapshotPath = ""
+	}()
+	for _, snapshotAt := range []int{0, len(journalCommands) / 2} {
+		dir, err := ioutil.TempDir("", "journal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		want := runJournaled(t, dir, snapshotAt)
+		if got := restart(t, dir); got != want {
+			t.Fatalf("market restarted with a snapshot at %d is\n%s\nwant\n%s", snapshotAt, got, want)
+		}
+	}
+}
+
+// TestReplay journals commands the way the server does and checks that
+// replaying the journal, from the start or after a snapshot, gives the same
+// events and the same market.
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	j, err := journal.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	clock := reactor.NewFakeClock(0)
+	m := reactor.CreateMarket(reactor.WithClock(clock))
+	snapshotAt := len(journalCommands) / 2
+	var snapshot bytes.Buffer
+	var events [][]reactor.Event
+	for i, data := range journalCommands {
+		if i == snapshotAt {
+			if err := m.Save(&snapshot); err != nil {
+				t.Fatal(err)
+			}
+		}
+		at := int64(i+1) * int64(2*time.Second)
+		clock.Set(at)
+		if _, err := j.Append(entryType(data), at, data); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, apply(m, data).Events)
+	}
+	var want bytes.Buffer
+	if err := m.Save(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := func(name string, replayed *reactor.Market, from uint64) {
+		t.Helper()
+		err := Replay(replayed, path, from, func(entry journal.Entry, list []reactor.Event) {
+			got, _ := json.Marshal(list)
+			logged, _ := json.Marshal(events[entry.Seq-1])
+			if !bytes.Equal(got, logged) {
+				t.Fatalf("%s: entry %d replays as\n%s\nwant\n%s", name, entry.Seq, got, logged)
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got bytes.Buffer
+		if err := replayed.Save(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("%s: market after the replay is\n%s\nwant\n%s", name, got.Bytes(), want.Bytes())
+		}
+	}
+
+	replay("from the start", reactor.CreateMarket(), 0)
+
+	loaded := reactor.CreateMarket()
+	if err := loaded.Load(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	replay("after the snapshot", loaded, uint64(snapshotAt))
+}
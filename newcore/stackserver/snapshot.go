@@ -0,0 +1,130 @@
+package stackserver
+
+import (
+	"../reactor"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// snapshotFile is a market snapshot together with the seq of the last journal
+// entry it contains.
+type snapshotFile struct {
+	JournalSeq uint64          `json:"journalSeq"`
+	Market     json.RawMessage `json:"market"`
+}
+
+var snapshotPath string
+var snapshotEvery int
+var sinceSnapshot int
+
+// loadSnapshot restores the fresh market from the snapshot at path, if there
+// is one, and returns the journal seq to replay from.
+func loadSnapshot(path string) uint64 {
+	journalSeq, err := LoadSnapshot(market, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Snapshot: loaded at journal seq %d \n", journalSeq)
+	return journalSeq
+}
+
+// LoadSnapshot restores the empty market m from the snapshot file at path and
+// returns the seq of the last journal entry the snapshot contains. A missing
+// file leaves m empty and returns 0.
+func LoadSnapshot(m *reactor.Market, path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return 0, err
+	}
+	if err := m.Load(bytes.NewReader(file.Market)); err != nil {
+		return 0, err
+	}
+	return file.JournalSeq, nil
+}
+
+// commandApplied takes a snapshot after every snapshotEvery commands that
+// changed the market.
+func commandApplied(data interface{}) {
+	if snapshotEvery <= 0 || entryType(data) == "" {
+		return
+	}
+	sinceSnapshot++
+	if sinceSnapshot < snapshotEvery {
+		return
+	}
+	if err := saveSnapshot(); err != nil {
+		log.Println(err)
+		return
+	}
+	sinceSnapshot = 0
+}
+
+// saveSnapshot replaces the snapshot file and then empties the journal. A
+// crash in between leaves journal entries the snapshot already contains,
+// which the next start skips.
+func saveSnapshot() error {
+	var buf bytes.Buffer
+	if err := market.Save(&buf); err != nil {
+		return err
+	}
+	file := snapshotFile{Market: buf.Bytes()}
+	if commandJournal != nil {
+		file.JournalSeq = commandJournal.Seq()
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(snapshotPath), filepath.Base(snapshotPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), snapshotPath); err != nil {
+		return err
+	}
+	// The rename is only durable once the directory is: truncating the
+	// journal before would lose both on a crash.
+	if err := syncDir(filepath.Dir(snapshotPath)); err != nil {
+		return err
+	}
+
+	if commandJournal != nil {
+		return commandJournal.Truncate()
+	}
+	return nil
+}
+
+// syncDir flushes the entries of a directory to disk.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
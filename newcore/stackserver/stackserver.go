@@ -2,20 +2,145 @@ package stackserver
 
 import (
 	"../reactor"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 )
 
+type CurrencyDTO struct {
+	Name    string `json:"name"`
+	Decimal uint8  `json:"decimal"`
+}
+
 type PairDTO struct {
 	Currency1 string `json:"currency1"`
 	Currency2 string `json:"currency2"`
 }
 
+// OrderDTO amounts are decimal numbers, sent either as JSON numbers or as
+// strings. They are parsed with the precision of the pair currencies. An
+// empty TimeInForce is GTC, ExpireTime is in Unix nanoseconds and only set
+// for GTD orders. A market order with a ProtectionPrice, the amount of
+// currency2 for one currency1, rests at that price with what the book could
+// not fill instead of being cancelled.
 type OrderDTO struct {
-	Id        uint64  `json:"id"`
-	PairName  string  `json:"pairName"`
-	IsGreen   bool    `json:"isGreen"`
-	Currency1 float64 `json:"currency1"`
-	Currency2 float64 `json:"currency2"`
+	Id              uint64              `json:"id"`
+	Owner           string              `json:"owner"`
+	PairName        string              `json:"pairName"`
+	IsGreen         bool                `json:"isGreen"`
+	Currency1       json.Number         `json:"currency1"`
+	Currency2       json.Number         `json:"currency2"`
+	TimeInForce     reactor.TimeInForce `json:"timeInForce,omitempty"`
+	ExpireTime      int64               `json:"expireTime,omitempty"`
+	ProtectionPrice json.Number         `json:"protectionPrice,omitempty"`
+}
+
+// CancelDTO cancels order Id. Owner, if set, restricts the cancel to an order
+// of that owner.
+type CancelDTO struct {
+	Id    uint64 `json:"id"`
+	Owner string `json:"owner,omitempty"`
+}
+
+// ExpireDTO cancels the GTD orders that have expired. The server sends it to
+// itself when one is due.
+type ExpireDTO struct{}
+
+// DepthDTO asks for the aggregated price levels of a pair, all of them when
+// Levels is zero.
+type DepthDTO struct {
+	PairName string `json:"pairName"`
+	Levels   int    `json:"levels"`
+}
+
+// BookDTO asks for every resting order of a pair.
+type BookDTO struct {
+	PairName string `json:"pairName"`
+}
+
+// FeesDTO replaces the fee schedule of a pair.
+type FeesDTO struct {
+	PairName string              `json:"pairName"`
+	Fees     reactor.FeeSchedule `json:"fees"`
+}
+
+// SlippageDTO replaces the slippage band of a pair.
+type SlippageDTO struct {
+	PairName string               `json:"pairName"`
+	Band     reactor.SlippageBand `json:"band"`
+}
+
+// DepositDTO and WithdrawDTO move money into and out of the available balance
+// of an account. TxId is chosen by the client; a transfer sent again with the
+// same TxId is not applied twice. Both are answered with the reactor.Transfer
+// of the TxId, the stored one when it is sent again.
+type DepositDTO struct {
+	TxId     string      `json:"txId"`
+	Account  string      `json:"account"`
+	Currency string      `json:"currency"`
+	Amount   json.Number `json:"amount"`
+}
+
+type WithdrawDTO struct {
+	TxId     string      `json:"txId"`
+	Account  string      `json:"account"`
+	Currency string      `json:"currency"`
+	Amount   json.Number `json:"amount"`
+}
+
+// BalancesDTO asks for the balances of an account.
+type BalancesDTO struct {
+	Account string `json:"account"`
+}
+
+// Command wraps a DTO whose sender waits for the outcome. The server answers
+// on Reply with the same CorrelationId. Reply must be buffered, the server
+// does not wait for a sender that gave up.
+type Command struct {
+	CorrelationId uint64
+	Data          interface{}
+	Reply         chan<- Reply
+}
+
+type Reply struct {
+	CorrelationId uint64               `json:"correlationId"`
+	Events        []reactor.Event      `json:"events"`
+	Result        interface{}          `json:"result,omitempty"`
+	Error         *reactor.MarketError `json:"error,omitempty"`
+}
+
+// ErrUnknownCommand answers data the server has no handler for, ErrJournal a
+// command that could not be written to the journal and was not applied.
+const (
+	ErrUnknownCommand reactor.ErrorCode = "unknown_command"
+	ErrJournal        reactor.ErrorCode = "journal"
+)
+
+// Options configure StartServer.
+type Options struct {
+	// JournalPath is the file every command changing the market is written
+	// to before it is applied. It is replayed into the market on start. No
+	// journal is kept when it is empty.
+	JournalPath string
+	// SnapshotPath is the file the state of the market is saved to after
+	// every SnapshotEvery commands changing it, emptying the journal. The
+	// market is loaded from it on start, before the journal is replayed.
+	SnapshotPath  string
+	SnapshotEvery int
+	// EventLogPath is the file every event sent to outData is appended to,
+	// one JSON object per line. No event log is kept when it is empty.
+	EventLogPath string
+	// Accounts ties orders to the balances of their owners, see
+	// reactor.WithAccounts.
+	Accounts bool
+	// ImprovementPolicy decides who gets the price improvement of swaps, the
+	// house when it is empty.
+	ImprovementPolicy reactor.ImprovementPolicy
+	// ExpireEvery is how often the server looks for expired GTD orders
+	// between commands. It does not when it is zero, expired orders are then
+	// only cancelled by the next order or cancel.
+	ExpireEvery time.Duration
 }
 
 var inChannel <-chan interface{}
@@ -23,35 +148,174 @@ var outChannel chan<- reactor.Event
 
 var market *reactor.Market
 
-func StartServer(inData <-chan interface{}, outData chan<- reactor.Event) {
-	market = reactor.CreateMarket()
+// commandClock is set to the time the current command was received. The
+// market takes its time from it and the journal keeps it for replays.
+var commandClock = reactor.NewFakeClock(0)
+
+// StartServer applies DTOs and Commands from inData to the market one at a
+// time. Every resulting event goes to outData, and Commands additionally get
+// their events back on their own reply channel.
+func StartServer(inData <-chan interface{}, outData chan<- reactor.Event, options Options) {
+	market = reactor.CreateMarket(MarketOptions(options)...)
 	inChannel = inData
 	outChannel = outData
 
+	var journalSeq uint64
+	if options.SnapshotPath != "" {
+		snapshotPath = options.SnapshotPath
+		snapshotEvery = options.SnapshotEvery
+		journalSeq = loadSnapshot(snapshotPath)
+	}
+	if options.JournalPath != "" {
+		openJournal(options.JournalPath, journalSeq)
+	}
+	if options.EventLogPath != "" {
+		openEventLog(options.EventLogPath)
+	}
+	market.SetClock(commandClock)
+
+	var expiryTicks <-chan time.Time
+	if options.ExpireEvery > 0 {
+		ticker := time.NewTicker(options.ExpireEvery)
+		defer ticker.Stop()
+		expiryTicks = ticker.C
+	}
+
 	for {
 
-		i := <-inChannel
+		var i interface{}
+		select {
+		case i = <-inChannel:
+		case now := <-expiryTicks:
+			if next, due := market.NextExpiry(); !due || next > now.UnixNano() {
+				continue
+			}
+			i = ExpireDTO{}
+		}
 
-		switch v := i.(type) {
-		case OrderDTO:
+		command, isCommand := i.(Command)
+		if !isCommand {
+			command = Command{Data: i}
+		}
 
-			events := market.AddNewOrder(v.Id, v.PairName, v.IsGreen, v.Currency1, v.Currency2)
+		commandClock.Set(time.Now().UnixNano())
+		reply := record(command.Data)
+		if reply.Error == nil {
+			reply = apply(market, command.Data)
+			commandApplied(command.Data)
+		}
+		reply.CorrelationId = command.CorrelationId
 
-			for _, e := range events {
-				outChannel <- e
+		logEvents(reply.Events)
+		for _, e := range reply.Events {
+			outChannel <- e
+		}
+		if command.Reply != nil {
+			select {
+			case command.Reply <- reply:
+			default:
+				fmt.Printf("Reply %d dropped \n", command.CorrelationId)
 			}
+		}
 
-		case PairDTO:
+	}
 
-			p, err := market.AddPair(v.Currency1, v.Currency2)
-			if !err {
-				fmt.Println(p)
-			}
+}
+
+// MarketOptions are the reactor options a market needs to run the commands of
+// a server started with options, in particular to replay its journal.
+func MarketOptions(options Options) []reactor.Option {
+	var list []reactor.Option
+	if options.Accounts {
+		list = append(list, reactor.WithAccounts())
+	}
+	if options.ImprovementPolicy != "" {
+		list = append(list, reactor.WithImprovementPolicy(options.ImprovementPolicy))
+	}
+	return list
+}
+
+func apply(market *reactor.Market, data interface{}) Reply {
+	var events []reactor.Event
+	var result interface{}
+	var err error
 
-		default:
-			fmt.Println("Type %T not found \n", v)
+	switch v := data.(type) {
+	case OrderDTO:
+
+		options := []reactor.OrderOption{reactor.WithTimeInForce(v.TimeInForce), reactor.WithExpireTime(v.ExpireTime)}
+		if v.ProtectionPrice != "" {
+			options = append(options, reactor.WithProtectionPriceString(v.ProtectionPrice.String()))
 		}
+		events, err = market.AddNewOrderString(v.Id, v.Owner, v.PairName, v.IsGreen, v.Currency1.String(), v.Currency2.String(), options...)
+
+	case CancelDTO:
+
+		if v.Owner != "" {
+			events, err = market.CancelOwnOrder(v.Id, v.Owner)
+		} else {
+			events, err = market.CancelOrder(v.Id)
+		}
+
+	case ExpireDTO:
+
+		events, err = market.Expire()
+
+	case DepositDTO:
+
+		events, err = market.DepositString(v.TxId, v.Account, v.Currency, v.Amount.String())
+		result, _ = market.Transfer(v.TxId)
+
+	case WithdrawDTO:
 
+		events, err = market.WithdrawString(v.TxId, v.Account, v.Currency, v.Amount.String())
+		result, _ = market.Transfer(v.TxId)
+
+	case BalancesDTO:
+
+		result, err = market.Balances(v.Account)
+
+	case CurrencyDTO:
+
+		result, err = market.AddCurrency(v.Name, v.Decimal)
+
+	case PairDTO:
+
+		_, err = market.AddPair(v.Currency1, v.Currency2)
+		result = v
+
+	case FeesDTO:
+
+		err = market.SetFees(v.PairName, v.Fees)
+		result = v
+
+	case SlippageDTO:
+
+		err = market.SetSlippageBand(v.PairName, v.Band)
+		result = v
+
+	case DepthDTO:
+
+		result, err = market.Depth(v.PairName, v.Levels)
+
+	case BookDTO:
+
+		result, err = market.Book(v.PairName)
+
+	default:
+		err = &reactor.MarketError{Code: ErrUnknownCommand, Message: fmt.Sprintf("type %T not found", v)}
 	}
 
+	reply := Reply{
+		Events: make([]reactor.Event, len(events)),
+		Result: result,
+	}
+	for i, e := range events {
+		reply.Events[i] = e.Clone()
+	}
+	if err != nil {
+		reply.Result = nil
+		errors.As(err, &reply.Error)
+	}
+	return reply
 }
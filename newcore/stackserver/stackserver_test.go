@@ -0,0 +1,107 @@
+package stackserver
+
+import (
+	"../reactor"
+	"sync"
+	"testing"
+)
+
+// startServer runs a server for the package tests. There is one market per
+// process, so the tests share it.
+func startServer() (chan<- interface{}, <-chan reactor.Event) {
+	in := make(chan interface{})
+	out := make(chan reactor.Event, 100)
+	go StartServer(in, out, Options{})
+	return in, out
+}
+
+var testIn chan<- interface{}
+var testOut <-chan reactor.Event
+var testServer sync.Once
+
+// call sends data as a Command and waits for its reply. The server is started
+// by the first call.
+func call(t *testing.T, correlationId uint64, data interface{}) Reply {
+	t.Helper()
+	testServer.Do(func() { testIn, testOut = startServer() })
+	reply := make(chan Reply, 1)
+	testIn <- Command{CorrelationId: correlationId, Data: data, Reply: reply}
+	r := <-reply
+	if r.CorrelationId != correlationId {
+		t.Fatalf("command %d answered as %d", correlationId, r.CorrelationId)
+	}
+	for range r.Events {
+		<-testOut
+	}
+	return r
+}
+
+func TestCancel(t *testing.T) {
+	call(t, 1, CurrencyDTO{Name: "AAA", Decimal: 0})
+	call(t, 2, CurrencyDTO{Name: "BBB", Decimal: 0})
+	call(t, 3, PairDTO{Currency1: "AAA", Currency2: "BBB"})
+	if r := call(t, 4, OrderDTO{Id: 1, PairName: "AAA/BBB", Currency1: "10", Currency2: "100"}); r.Error != nil {
+		t.Fatalf("order answered %+v", r)
+	}
+
+	r := call(t, 5, CancelDTO{Id: 1})
+	if r.Error != nil || len(r.Events) == 0 || r.Events[0].EventType != reactor.Cancel || !r.Events[0].Order.IsClose {
+		t.Fatalf("cancel answered %+v", r)
+	}
+	if r := call(t, 6, CancelDTO{Id: 1}); r.Error == nil || r.Error.Code != reactor.ErrOrderClosed {
+		t.Fatalf("second cancel answered %+v", r)
+	}
+	if r := call(t, 7, CancelDTO{Id: 2}); r.Error == nil || r.Error.Code != reactor.ErrUnknownOrder {
+		t.Fatalf("cancel of an unknown order answered %+v", r)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	if r := call(t, 42, struct{}{}); r.Error == nil || r.Error.Code != ErrUnknownCommand || len(r.Events) != 0 {
+		t.Fatalf("unknown command answered %+v", r)
+	}
+	r := call(t, 43, CurrencyDTO{Name: "CCC", Decimal: 2})
+	if currency, ok := r.Result.(*reactor.Currency); r.Error != nil || !ok || currency.Name != "CCC" {
+		t.Fatalf("currency answered %+v", r)
+	}
+	if r := call(t, 44, CurrencyDTO{Name: "CCC", Decimal: 2}); r.Result != nil || r.Error.Code != reactor.ErrDuplicateCurrency {
+		t.Fatalf("duplicate currency answered %+v", r)
+	}
+
+	// Plain DTOs are still applied, their events only go to the stream.
+	testIn <- CurrencyDTO{Name: "DDD", Decimal: 0}
+	testIn <- PairDTO{Currency1: "DDD", Currency2: "CCC"}
+	testIn <- OrderDTO{Id: 100, PairName: "DDD/CCC", Currency1: "1", Currency2: "1"}
+	if e := <-testOut; e.EventType != reactor.Create || e.Order.Id != 100 {
+		t.Fatalf("plain order streamed %+v", e)
+	}
+
+	// A sender that gave up does not block the server.
+	testIn <- Command{CorrelationId: 45, Data: CancelDTO{Id: 100}, Reply: make(chan Reply)}
+	<-testOut
+	if r := call(t, 46, CancelDTO{Id: 100}); r.Error == nil || r.Error.Code != reactor.ErrOrderClosed {
+		t.Fatalf("cancel after a dropped reply answered %+v", r)
+	}
+}
+
+// TestTransferResult checks that a transfer is answered with the stored
+// Transfer, also when it is sent again.
+func TestTransferResult(t *testing.T) {
+	m := reactor.CreateMarket(reactor.WithAccounts())
+	m.AddCurrency("USD", 2)
+	deposit := DepositDTO{TxId: "tx1", Account: "a", Currency: "USD", Amount: "10.5"}
+	first := apply(m, deposit)
+	again := apply(m, deposit)
+	for _, r := range []Reply{first, again} {
+		transfer, ok := r.Result.(*reactor.Transfer)
+		if r.Error != nil || !ok || transfer.TxId != "tx1" || transfer.Money.Amount != 1050 || transfer.Balance.Available != 1050 {
+			t.Fatalf("deposit answered %+v", r)
+		}
+	}
+	if len(again.Events) != 0 {
+		t.Fatalf("deposit sent again answered with events %+v", again.Events)
+	}
+	if r := apply(m, WithdrawDTO{TxId: "tx1", Account: "a", Currency: "USD", Amount: "1"}); r.Result != nil || r.Error == nil {
+		t.Fatalf("withdrawal reusing the transaction answered %+v", r)
+	}
+}
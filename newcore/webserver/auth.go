@@ -0,0 +1,62 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// tokens maps the bearer tokens the webserver accepts to the owner each one
+// authenticates. The token of reactor.HouseAccount is the one of the operator
+// of the market. Without tokens no request is authenticated and the API
+// trusts every caller, so it must only be reachable by trusted clients.
+var tokens map[string]string
+
+// LoadTokens reads the tokens from a JSON file of the form
+// {"<token>": "<owner>"}. It is a stand-in for real authentication: whoever
+// holds the token of an owner acts as that owner.
+func LoadTokens(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	list := make(map[string]string)
+	if err := json.NewDecoder(file).Decode(&list); err != nil {
+		return err
+	}
+	tokens = list
+	return nil
+}
+
+// authenticated returns the owner of the token of the request, given as
+// "Authorization: Bearer <token>" or, for WebSocket clients that cannot set
+// headers, as ?token=<token>. It is empty for a request without a known token.
+func authenticated(r *http.Request) string {
+	token := r.URL.Query().Get("token")
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if token == "" {
+		return ""
+	}
+	return tokens[token]
+}
+
+// authorize tells whether the request may act for owner, and answers 401 or
+// 403 when it may not. Every request may while no tokens are loaded.
+func authorize(w http.ResponseWriter, r *http.Request, owner string) bool {
+	if tokens == nil {
+		return true
+	}
+	switch authenticated(r) {
+	case "":
+		http.Error(w, "token required", http.StatusUnauthorized)
+		return false
+	case owner:
+		return true
+	}
+	http.Error(w, "not allowed for this token", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,207 @@
+package webserver
+
+import (
+	"../reactor"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Topics a WebSocket client can subscribe to. Public topics are suffixed with
+// a pair name ("trades:BTC/USD"), the private one with the owner the
+// connection authenticated as ("orders:alice").
+const (
+	TradesTopic = "trades:"
+	BookTopic   = "book:"
+	OrdersTopic = "orders:"
+)
+
+const (
+	clientBuffer = 256
+	writeWait    = 10 * time.Second
+)
+
+// Subscription is the message a client sends to change its topics.
+type Subscription struct {
+	Action string `json:"action"`
+	Topic  string `json:"topic"`
+}
+
+// StreamMessage is what a client receives for every event on its topics.
+type StreamMessage struct {
+	Topic string        `json:"topic"`
+	Event reactor.Event `json:"event"`
+}
+
+type client struct {
+	owner  string
+	conn   *websocket.Conn
+	send   chan StreamMessage
+	topics map[string]bool
+}
+
+// hub fans the events of the stackserver out to the subscribed clients. A
+// client that does not keep up with its buffer is disconnected.
+type hub struct {
+	mu      sync.Mutex
+	clients map[*client]bool
+}
+
+var streams = hub{clients: make(map[*client]bool)}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// messages lists the message for every topic an event is published on.
+// Public topics get the event without the owners of its orders, the private
+// topic of an owner only with its own.
+func messages(e reactor.Event) []StreamMessage {
+	var list []StreamMessage
+	if pairName := e.PairName(); pairName != "" && e.EventType != reactor.Error {
+		public := anonymous(e, "")
+		if e.EventType == reactor.SwapOrder {
+			list = append(list, StreamMessage{Topic: TradesTopic + pairName, Event: public})
+		}
+		list = append(list, StreamMessage{Topic: BookTopic + pairName, Event: public})
+	}
+	for _, owner := range e.Owners() {
+		list = append(list, StreamMessage{Topic: OrdersTopic + owner, Event: anonymous(e, owner)})
+	}
+	return list
+}
+
+// anonymous returns a copy of the event with the owners of its orders
+// removed, except owner.
+func anonymous(e reactor.Event, owner string) reactor.Event {
+	e = e.Clone()
+	if e.Order != nil && e.Order.Owner != owner {
+		e.Order.Owner = ""
+	}
+	if e.Swap != nil {
+		if e.Swap.Green.Owner != owner {
+			e.Swap.Green.Owner = ""
+		}
+		if e.Swap.Red.Owner != owner {
+			e.Swap.Red.Owner = ""
+		}
+	}
+	return e
+}
+
+func (h *hub) run(events <-chan reactor.Event) {
+	for e := range events {
+		h.publish(e)
+	}
+}
+
+func (h *hub) publish(e reactor.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, message := range messages(e) {
+		for c := range h.clients {
+			if !c.topics[message.Topic] {
+				continue
+			}
+			select {
+			case c.send <- message:
+			default:
+				h.drop(c)
+			}
+		}
+	}
+}
+
+func (h *hub) add(c *client) {
+	h.mu.Lock()
+	h.clients[c] = true
+	h.mu.Unlock()
+}
+
+func (h *hub) remove(c *client) {
+	h.mu.Lock()
+	h.drop(c)
+	h.mu.Unlock()
+}
+
+// drop must be called with the lock held.
+func (h *hub) drop(c *client) {
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+func (h *hub) subscribe(c *client, s Subscription) bool {
+	if strings.HasPrefix(s.Topic, OrdersTopic) && (c.owner == "" || s.Topic != OrdersTopic+c.owner) {
+		return false
+	}
+	if !strings.HasPrefix(s.Topic, OrdersTopic) && !strings.HasPrefix(s.Topic, TradesTopic) &&
+		!strings.HasPrefix(s.Topic, BookTopic) {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch s.Action {
+	case "subscribe":
+		c.topics[s.Topic] = true
+	case "unsubscribe":
+		delete(c.topics, s.Topic)
+	default:
+		return false
+	}
+	return true
+}
+
+// stream upgrades GET /ws to a WebSocket. A connection opened with the token
+// of an owner may subscribe to the private orders topic of that owner and no
+// other, see authenticated.
+func stream(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	c := &client{
+		owner:  authenticated(r),
+		conn:   conn,
+		send:   make(chan StreamMessage, clientBuffer),
+		topics: make(map[string]bool),
+	}
+	streams.add(c)
+	go c.write()
+	c.read()
+}
+
+func (c *client) read() {
+	defer func() {
+		streams.remove(c)
+		c.conn.Close()
+	}()
+	for {
+		var s Subscription
+		if err := c.conn.ReadJSON(&s); err != nil {
+			return
+		}
+		if !streams.subscribe(c, s) {
+			log.Printf("Subscription %+v refused \n", s)
+		}
+	}
+}
+
+func (c *client) write() {
+	defer c.conn.Close()
+	for message := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := c.conn.WriteJSON(message); err != nil {
+			return
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+}
@@ -0,0 +1,151 @@
+package webserver
+
+import (
+	"../reactor"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// topics lists the topics of the messages of an event.
+func topics(e reactor.Event) []string {
+	var list []string
+	for _, message := range messages(e) {
+		list = append(list, message.Topic)
+	}
+	return list
+}
+
+func TestTopics(t *testing.T) {
+	m := reactor.CreateMarket()
+	m.AddCurrency("AAA", 0)
+	m.AddCurrency("BBB", 0)
+	m.AddPair("AAA", "BBB")
+	m.AddNewOrder(1, "alice", "AAA/BBB", false, 10, 100)
+	events, err := m.AddNewOrder(2, "bob", "AAA/BBB", true, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var swap reactor.Event
+	for _, e := range events {
+		if e.EventType == reactor.SwapOrder {
+			swap = e
+		}
+	}
+	if got := fmt.Sprint(topics(swap)); got != "[trades:AAA/BBB book:AAA/BBB orders:bob orders:alice]" {
+		t.Fatalf("swap is published on %s", got)
+	}
+
+	events, _ = m.CancelOrder(1)
+	if got := fmt.Sprint(topics(events[0])); got != "[orders:alice]" {
+		t.Fatalf("refused cancel is published on %s", got)
+	}
+}
+
+func TestMessagesHideOwnersOnPublicTopics(t *testing.T) {
+	m := reactor.CreateMarket()
+	m.AddCurrency("AAA", 0)
+	m.AddCurrency("BBB", 0)
+	m.AddPair("AAA", "BBB")
+	m.AddNewOrder(1, "alice", "AAA/BBB", false, 10, 100)
+	events, err := m.AddNewOrder(2, "bob", "AAA/BBB", true, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range events {
+		for _, message := range messages(e) {
+			owners := message.Event.Owners()
+			switch message.Topic {
+			case OrdersTopic + "alice", OrdersTopic + "bob":
+				if len(owners) == 0 {
+					t.Errorf("event %d on %s has no owner", e.Id, message.Topic)
+				}
+			default:
+				if len(owners) != 0 {
+					t.Errorf("event %d on %s shows owners %v", e.Id, message.Topic, owners)
+				}
+			}
+		}
+		if e.Swap != nil && (e.Swap.Green.Owner != "bob" || e.Swap.Red.Owner != "alice") {
+			t.Fatalf("publishing changed the owners of the swap: %+v", e.Swap)
+		}
+	}
+}
+
+func TestMessagesHideCounterparties(t *testing.T) {
+	m := reactor.CreateMarket()
+	m.AddCurrency("AAA", 0)
+	m.AddCurrency("BBB", 0)
+	m.AddPair("AAA", "BBB")
+	m.AddNewOrder(1, "alice", "AAA/BBB", false, 10, 100)
+	events, _ := m.AddNewOrder(2, "bob", "AAA/BBB", true, 10, 100)
+
+	for _, e := range events {
+		for _, message := range messages(e) {
+			owner := strings.TrimPrefix(message.Topic, OrdersTopic)
+			if owner == message.Topic {
+				continue
+			}
+			if owners := message.Event.Owners(); len(owners) != 1 || owners[0] != owner {
+				t.Errorf("event %d on %s shows owners %v", e.Id, message.Topic, owners)
+			}
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	alice := &client{owner: "alice", topics: make(map[string]bool)}
+	anonymous := &client{topics: make(map[string]bool)}
+	tests := []struct {
+		client *client
+		action string
+		topic  string
+		ok     bool
+	}{
+		{alice, "subscribe", OrdersTopic + "alice", true},
+		{alice, "subscribe", OrdersTopic + "bob", false},
+		{alice, "subscribe", TradesTopic + "AAA/BBB", true},
+		{alice, "unsubscribe", TradesTopic + "AAA/BBB", true},
+		{alice, "listen", BookTopic + "AAA/BBB", false},
+		{anonymous, "subscribe", OrdersTopic, false},
+		{anonymous, "subscribe", BookTopic + "AAA/BBB", true},
+		{anonymous, "subscribe", "prices:AAA/BBB", false},
+	}
+	for _, test := range tests {
+		if ok := streams.subscribe(test.client, Subscription{Action: test.action, Topic: test.topic}); ok != test.ok {
+			t.Errorf("%s of %q to %s answered %t", test.action, test.client.owner, test.topic, ok)
+		}
+	}
+	if len(alice.topics) != 1 || !alice.topics[OrdersTopic+"alice"] {
+		t.Fatalf("alice is subscribed to %v", alice.topics)
+	}
+}
+
+func TestAuthenticated(t *testing.T) {
+	saved := tokens
+	defer func() { tokens = saved }()
+	tokens = map[string]string{"secret": "alice"}
+
+	tests := []struct {
+		target string
+		header string
+		owner  string
+	}{
+		{"/ws?token=secret", "", "alice"},
+		{"/ws", "Bearer secret", "alice"},
+		{"/ws?owner=alice", "", ""},
+		{"/ws?token=guess", "", ""},
+		{"/ws", "Bearer guess", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.target, nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if owner := authenticated(r); owner != test.owner {
+			t.Errorf("%s with %q authenticated %q, want %q", test.target, test.header, owner, test.owner)
+		}
+	}
+}
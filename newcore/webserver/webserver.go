@@ -1,44 +1,209 @@
 package webserver
 
 import (
+	"../reactor"
 	"../stackserver"
 	"encoding/json"
-	"fmt"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 var dataChannel chan<- interface{}
+var replyTimeout time.Duration
+var lastCorrelationId uint64
 
-func StartServer(stackChannel chan<- interface{}) {
+// StartServer serves the HTTP API. Every request is sent to the stackserver
+// as a Command and answered with its Reply, or with 504 when no reply came
+// within timeout. The events of the stackserver are streamed to WebSocket
+// clients on /ws. Once tokens are loaded, see LoadTokens, orders, cancels,
+// withdrawals and balances need the token of their owner, and currencies,
+// pairs, fees, slippage bands and deposits the one of the operator.
+func StartServer(stackChannel chan<- interface{}, eventChannel <-chan reactor.Event, timeout time.Duration) {
 	dataChannel = stackChannel
+	replyTimeout = timeout
+
+	go streams.run(eventChannel)
 
 	r := mux.NewRouter()
+	r.HandleFunc("/currency", addCurrency).Methods("POST")
 	r.HandleFunc("/pair", addPair).Methods("POST")
 	r.HandleFunc("/order", addOrder).Methods("POST")
+	r.HandleFunc("/order/{id}", cancelOrder).Methods("DELETE")
+	r.HandleFunc("/pair/{base}/{quote}/book", getBook).Methods("GET")
+	r.HandleFunc("/pair/{base}/{quote}/fees", setFees).Methods("PUT")
+	r.HandleFunc("/pair/{base}/{quote}/slippage", setSlippage).Methods("PUT")
+	r.HandleFunc("/account/{id}", getBalances).Methods("GET")
+	r.HandleFunc("/account/{id}/deposit", deposit).Methods("POST")
+	r.HandleFunc("/account/{id}/withdraw", withdraw).Methods("POST")
+	r.HandleFunc("/ws", stream).Methods("GET")
 	log.Fatal(http.ListenAndServe(":8000", r))
 
 }
 
 func addOrder(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
 	var order stackserver.OrderDTO
-	err := json.NewDecoder(r.Body).Decode(&order)
+	if decode(w, r, &order) && authorize(w, r, order.Owner) {
+		send(w, order)
+	}
+}
+
+func cancelOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
 	if err != nil {
-		fmt.Printf(err.Error())
+		http.Error(w, "order id must be a number", http.StatusBadRequest)
+		return
+	}
+	cancel := stackserver.CancelDTO{Id: id}
+	if tokens != nil {
+		if cancel.Owner = authenticated(r); cancel.Owner == "" {
+			http.Error(w, "token required", http.StatusUnauthorized)
+			return
+		}
+	}
+	send(w, cancel)
+}
+
+// getBook answers GET /pair/{base}/{quote}/book with the aggregated price
+// levels, limited to ?depth=N per side, or with every resting order when
+// asked for ?level=3.
+func getBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pairName := vars["base"] + "/" + vars["quote"]
+	query := r.URL.Query()
+
+	if query.Get("level") == "3" {
+		send(w, stackserver.BookDTO{PairName: pairName})
+		return
+	}
+
+	depth := 0
+	if s := query.Get("depth"); s != "" {
+		var err error
+		depth, err = strconv.Atoi(s)
+		if err != nil || depth < 0 {
+			http.Error(w, "depth must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+	send(w, stackserver.DepthDTO{PairName: pairName, Levels: depth})
+}
+
+// setFees takes the pair from the path and a reactor.FeeSchedule as the body.
+func setFees(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fees := stackserver.FeesDTO{PairName: vars["base"] + "/" + vars["quote"]}
+	if authorize(w, r, reactor.HouseAccount) && decode(w, r, &fees.Fees) {
+		send(w, fees)
+	}
+}
+
+// setSlippage takes the pair from the path and a reactor.SlippageBand as the
+// body.
+func setSlippage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	slippage := stackserver.SlippageDTO{PairName: vars["base"] + "/" + vars["quote"]}
+	if authorize(w, r, reactor.HouseAccount) && decode(w, r, &slippage.Band) {
+		send(w, slippage)
+	}
+}
+
+// deposit and withdraw take the account from the path, the body supplies the
+// txId, currency and amount.
+func deposit(w http.ResponseWriter, r *http.Request) {
+	var transfer stackserver.DepositDTO
+	if authorize(w, r, reactor.HouseAccount) && decode(w, r, &transfer) {
+		transfer.Account = mux.Vars(r)["id"]
+		send(w, transfer)
+	}
+}
+
+func withdraw(w http.ResponseWriter, r *http.Request) {
+	var transfer stackserver.WithdrawDTO
+	if authorize(w, r, mux.Vars(r)["id"]) && decode(w, r, &transfer) {
+		transfer.Account = mux.Vars(r)["id"]
+		send(w, transfer)
 	}
-	dataChannel <- order
+}
 
+func getBalances(w http.ResponseWriter, r *http.Request) {
+	account := mux.Vars(r)["id"]
+	if authorize(w, r, account) {
+		send(w, stackserver.BalancesDTO{Account: account})
+	}
 }
 
 func addPair(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
 	var pair stackserver.PairDTO
-	err := json.NewDecoder(r.Body).Decode(&pair)
+	if authorize(w, r, reactor.HouseAccount) && decode(w, r, &pair) {
+		send(w, pair)
+	}
+}
+
+func addCurrency(w http.ResponseWriter, r *http.Request) {
+	var currency stackserver.CurrencyDTO
+	if authorize(w, r, reactor.HouseAccount) && decode(w, r, &currency) {
+		send(w, currency)
+	}
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
 	if err != nil {
-		fmt.Printf(err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
 	}
-	dataChannel <- pair
+	return true
+}
 
+// send hands data to the stackserver and writes its reply.
+func send(w http.ResponseWriter, data interface{}) {
+	reply := make(chan stackserver.Reply, 1)
+	command := stackserver.Command{
+		CorrelationId: atomic.AddUint64(&lastCorrelationId, 1),
+		Data:          data,
+		Reply:         reply,
+	}
+
+	timer := time.NewTimer(replyTimeout)
+	defer timer.Stop()
+
+	select {
+	case dataChannel <- command:
+	case <-timer.C:
+		http.Error(w, "stackserver is busy", http.StatusServiceUnavailable)
+		return
+	}
+
+	select {
+	case result := <-reply:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status(result.Error))
+		json.NewEncoder(w).Encode(result)
+	case <-timer.C:
+		http.Error(w, "no reply from stackserver", http.StatusGatewayTimeout)
+	}
+}
+
+// status is the HTTP status of a reply with err. A command the journal could
+// not take was not applied and may be sent again later.
+func status(err *reactor.MarketError) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	switch err.Code {
+	case reactor.ErrUnknownOrder, reactor.ErrUnknownPair, reactor.ErrUnknownCurrency:
+		return http.StatusNotFound
+	case reactor.ErrDuplicateOrder, reactor.ErrDuplicatePair, reactor.ErrDuplicateCurrency, reactor.ErrOrderClosed,
+		reactor.ErrDuplicateTransfer:
+		return http.StatusConflict
+	case reactor.ErrInvariant, stackserver.ErrUnknownCommand:
+		return http.StatusInternalServerError
+	case stackserver.ErrJournal:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusUnprocessableEntity
 }
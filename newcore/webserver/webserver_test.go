@@ -0,0 +1,274 @@
+package webserver
+
+import (
+	"../reactor"
+	"../stackserver"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStack answers every Command with answer, until stop is closed.
+func fakeStack(answer func(command stackserver.Command) stackserver.Reply) (stop func()) {
+	stack := make(chan interface{})
+	done := make(chan struct{})
+	dataChannel = stack
+	replyTimeout = time.Second
+	go func() {
+		for {
+			select {
+			case data := <-stack:
+				command := data.(stackserver.Command)
+				reply := answer(command)
+				reply.CorrelationId = command.CorrelationId
+				command.Reply <- reply
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func TestCancelOrder(t *testing.T) {
+	var sent interface{}
+	defer fakeStack(func(command stackserver.Command) stackserver.Reply {
+		sent = command.Data
+		return stackserver.Reply{}
+	})()
+
+	r := httptest.NewRequest("DELETE", "/order/7", nil)
+	w := httptest.NewRecorder()
+	cancelOrder(w, mux.SetURLVars(r, map[string]string{"id": "7"}))
+	if w.Code != http.StatusOK || sent != (stackserver.CancelDTO{Id: 7}) {
+		t.Fatalf("DELETE /order/7 sent %+v and answered %d", sent, w.Code)
+	}
+
+	sent = nil
+	w = httptest.NewRecorder()
+	cancelOrder(w, mux.SetURLVars(r, map[string]string{"id": "seven"}))
+	if w.Code != http.StatusBadRequest || sent != nil {
+		t.Fatalf("DELETE /order/seven answered %d", w.Code)
+	}
+}
+
+func TestSend(t *testing.T) {
+	defer fakeStack(func(command stackserver.Command) stackserver.Reply {
+		if command.Data == (stackserver.CancelDTO{Id: 1}) {
+			return stackserver.Reply{Error: &reactor.MarketError{Code: reactor.ErrUnknownOrder, Message: "order 1 not found"}}
+		}
+		return stackserver.Reply{Result: command.Data}
+	})()
+
+	w := httptest.NewRecorder()
+	send(w, stackserver.CancelDTO{Id: 2})
+	var reply stackserver.Reply
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("reply %d: %v", w.Code, err)
+	}
+	if reply.CorrelationId != lastCorrelationId || reply.Result == nil {
+		t.Fatalf("reply is %+v, want the result of command %d", reply, lastCorrelationId)
+	}
+
+	w = httptest.NewRecorder()
+	send(w, stackserver.CancelDTO{Id: 1})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown order answered %d", w.Code)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	replyTimeout = 10 * time.Millisecond
+
+	// Nobody reads the channel: the stackserver is busy.
+	dataChannel = make(chan interface{})
+	w := httptest.NewRecorder()
+	send(w, stackserver.CancelDTO{Id: 1})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("busy stackserver answered %d", w.Code)
+	}
+
+	// The command is taken but never answered.
+	dataChannel = make(chan interface{}, 1)
+	w = httptest.NewRecorder()
+	send(w, stackserver.CancelDTO{Id: 1})
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("missing reply answered %d", w.Code)
+	}
+}
+
+func TestGetBook(t *testing.T) {
+	var sent interface{}
+	defer fakeStack(func(command stackserver.Command) stackserver.Reply {
+		sent = command.Data
+		return stackserver.Reply{}
+	})()
+	vars := map[string]string{"base": "BTC", "quote": "USD"}
+
+	tests := []struct {
+		query string
+		sent  interface{}
+		code  int
+	}{
+		{"", stackserver.DepthDTO{PairName: "BTC/USD"}, http.StatusOK},
+		{"?depth=5", stackserver.DepthDTO{PairName: "BTC/USD", Levels: 5}, http.StatusOK},
+		{"?level=3", stackserver.BookDTO{PairName: "BTC/USD"}, http.StatusOK},
+		{"?depth=-1", nil, http.StatusBadRequest},
+		{"?depth=five", nil, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		sent = nil
+		r := httptest.NewRequest("GET", "/pair/BTC/USD/book"+test.query, nil)
+		w := httptest.NewRecorder()
+		getBook(w, mux.SetURLVars(r, vars))
+		if w.Code != test.code || sent != test.sent {
+			t.Errorf("GET book%s sent %+v and answered %d", test.query, sent, w.Code)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	var sent interface{}
+	defer fakeStack(func(command stackserver.Command) stackserver.Reply {
+		sent = command.Data
+		return stackserver.Reply{}
+	})()
+	vars := map[string]string{"id": "alice"}
+
+	// The account comes from the path, whatever the body says.
+	body := `{"txId":"tx1","account":"bob","currency":"USD","amount":"10.5"}`
+	w := httptest.NewRecorder()
+	deposit(w, mux.SetURLVars(httptest.NewRequest("POST", "/account/alice/deposit", strings.NewReader(body)), vars))
+	want := stackserver.DepositDTO{TxId: "tx1", Account: "alice", Currency: "USD", Amount: "10.5"}
+	if w.Code != http.StatusOK || sent != want {
+		t.Fatalf("deposit sent %+v and answered %d", sent, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	withdraw(w, mux.SetURLVars(httptest.NewRequest("POST", "/account/alice/withdraw", strings.NewReader(body)), vars))
+	if w.Code != http.StatusOK || sent != stackserver.WithdrawDTO(want) {
+		t.Fatalf("withdrawal sent %+v and answered %d", sent, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	getBalances(w, mux.SetURLVars(httptest.NewRequest("GET", "/account/alice", nil), vars))
+	if w.Code != http.StatusOK || sent != (stackserver.BalancesDTO{Account: "alice"}) {
+		t.Fatalf("balances sent %+v and answered %d", sent, w.Code)
+	}
+}
+
+func TestSetFees(t *testing.T) {
+	var sent interface{}
+	defer fakeStack(func(command stackserver.Command) stackserver.Reply {
+		sent = command.Data
+		return stackserver.Reply{}
+	})()
+
+	body := `{"maker":1000,"taker":2000,"tiers":[{"volume":500,"maker":0,"taker":1000}]}`
+	r := httptest.NewRequest("PUT", "/pair/BTC/USD/fees", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	setFees(w, mux.SetURLVars(r, map[string]string{"base": "BTC", "quote": "USD"}))
+	want := stackserver.FeesDTO{PairName: "BTC/USD", Fees: reactor.FeeSchedule{
+		Maker: 1000, Taker: 2000, Tiers: []reactor.FeeTier{{Volume: 500, Maker: 0, Taker: 1000}},
+	}}
+	if w.Code != http.StatusOK || !reflect.DeepEqual(sent, want) {
+		t.Fatalf("PUT fees sent %+v and answered %d", sent, w.Code)
+	}
+}
+
+func TestSetSlippage(t *testing.T) {
+	var sent interface{}
+	defer fakeStack(func(command stackserver.Command) stackserver.Reply {
+		sent = command.Data
+		return stackserver.Reply{}
+	})()
+
+	r := httptest.NewRequest("PUT", "/pair/BTC/USD/slippage", strings.NewReader(`{"max":50000,"reference":"last"}`))
+	w := httptest.NewRecorder()
+	setSlippage(w, mux.SetURLVars(r, map[string]string{"base": "BTC", "quote": "USD"}))
+	want := stackserver.SlippageDTO{PairName: "BTC/USD", Band: reactor.SlippageBand{Max: 50000, Reference: reactor.FromLastTrade}}
+	if w.Code != http.StatusOK || sent != want {
+		t.Fatalf("PUT slippage sent %+v and answered %d", sent, w.Code)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	var sent interface{}
+	defer fakeStack(func(command stackserver.Command) stackserver.Reply {
+		sent = command.Data
+		return stackserver.Reply{}
+	})()
+	saved := tokens
+	defer func() { tokens = saved }()
+	tokens = map[string]string{"a": "alice", "h": reactor.HouseAccount}
+
+	body := `{"txId":"tx1","currency":"USD","amount":"1"}`
+	order := `{"id":1,"owner":"alice","pairName":"AAA/BBB","currency1":"1","currency2":"1"}`
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		token   string
+		code    int
+	}{
+		{"withdrawal without token", withdraw, body, "", http.StatusUnauthorized},
+		{"withdrawal of another account", withdraw, body, "h", http.StatusForbidden},
+		{"withdrawal", withdraw, body, "a", http.StatusOK},
+		{"balances of another account", getBalances, "", "h", http.StatusForbidden},
+		{"deposit of an owner", deposit, body, "a", http.StatusForbidden},
+		{"deposit of the operator", deposit, body, "h", http.StatusOK},
+		{"order without token", addOrder, order, "", http.StatusUnauthorized},
+		{"order for another owner", addOrder, order, "h", http.StatusForbidden},
+		{"order", addOrder, order, "a", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		test.handler(w, mux.SetURLVars(r, map[string]string{"id": "alice"}))
+		if w.Code != test.code {
+			t.Errorf("%s answered %d, want %d", test.name, w.Code, test.code)
+		}
+	}
+
+	r := httptest.NewRequest("DELETE", "/order/7", nil)
+	w := httptest.NewRecorder()
+	cancelOrder(w, mux.SetURLVars(r, map[string]string{"id": "7"}))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("cancel without token answered %d", w.Code)
+	}
+	r.Header.Set("Authorization", "Bearer a")
+	cancelOrder(httptest.NewRecorder(), mux.SetURLVars(r, map[string]string{"id": "7"}))
+	if sent != (stackserver.CancelDTO{Id: 7, Owner: "alice"}) {
+		t.Fatalf("cancel with a token sent %+v", sent)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		code   reactor.ErrorCode
+		status int
+	}{
+		{reactor.ErrUnknownOrder, http.StatusNotFound},
+		{reactor.ErrDuplicateTransfer, http.StatusConflict},
+		{reactor.ErrInvalidAmount, http.StatusUnprocessableEntity},
+		{reactor.ErrInvariant, http.StatusInternalServerError},
+		{stackserver.ErrUnknownCommand, http.StatusInternalServerError},
+		{stackserver.ErrJournal, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		if status := status(&reactor.MarketError{Code: test.code}); status != test.status {
+			t.Errorf("%s answered %d, want %d", test.code, status, test.status)
+		}
+	}
+	if status := status(nil); status != http.StatusOK {
+		t.Errorf("no error answered %d", status)
+	}
+}